@@ -1,7 +1,10 @@
 package htmldiff
 
 import (
-	"sort"
+	"bytes"
+	"context"
+	"io"
+	"strings"
 
 	"golang.org/x/net/html"
 	"golang.org/x/net/html/atom"
@@ -14,7 +17,14 @@ type appendContext struct {
 	lastText                      string
 	lastAction                    rune
 	lastPos                       posT
+	lastOther                     *treeRune
 	editList                      []editEntry
+	fallback                      Fallback
+	revisions                     []Revision                  // for Blame
+	base, edit                    *source                     // the versions compared, for HTMLdiffDocuments
+	pairs                         *nodePairs                  // the elements of the versions compared with text in common, if known
+	strictPairs                   bool                        // for Resolve, see nodePairs.sameElement()
+	sources                       map[*html.Node][]*html.Node // the elements in the versions which each element in the target was made from
 }
 
 // an individual edit action.
@@ -24,6 +34,14 @@ type editEntry struct {
 	proto   *html.Node
 	pos     posT
 	origSeq int
+	id      int // of the change, shared by consecutive entries with the same action, zero for '='
+	move    int // for text moved from or to another place, the number of the move
+
+	// for '=' the counterpart in the new version, for '~' the counterpart in the old version
+	other    *html.Node
+	otherPos posT
+
+	introduced, removed int // for Blame, the revisions which introduced and removed the text
 }
 
 // Len is part of sort.Interface.
@@ -38,7 +56,8 @@ func (ap *appendContext) Swap(i, j int) {
 
 // Less is part of sort.Interface.
 func (ap *appendContext) Less(i, j int) bool {
-	if len(ap.editList[i].pos) > 0 && len(ap.editList[j].pos) > 0 { // if both are in containers
+	if len(ap.editList[i].pos) > 0 && len(ap.editList[j].pos) > 0 && // if both are in the same containers
+		ap.sameElement(ap.editList[i].pos[len(ap.editList[i].pos)-1].node, ap.editList[j].pos[len(ap.editList[j].pos)-1].node) {
 		ii := len(ap.editList[i].pos) - 1
 		jj := len(ap.editList[j].pos) - 1
 		for ii > 0 && jj > 0 {
@@ -56,7 +75,8 @@ func (ap *appendContext) Less(i, j int) bool {
 }
 
 // append a treeRune at location idx to the output, group similar runes together to before calling append0().
-func (ap *appendContext) append(action rune, trs []treeRune, idx int) {
+// For '=' and '~' other is the equivalent treeRune in the other version.
+func (ap *appendContext) append(action rune, trs []treeRune, idx int, other *treeRune) {
 	if idx >= len(trs) { // defending error found by fuzz testing
 		return
 	}
@@ -74,54 +94,127 @@ func (ap *appendContext) append(action rune, trs []treeRune, idx int) {
 			return
 		}
 	}
-	var text string
-	if tr.letter > 0 {
-		text = string(tr.letter)
-	}
-	if ap.lastProto == tr.leaf && ap.lastAction == action && tr.leaf.Type == html.TextNode && text != "" && posEqual(ap.lastPos, tr.pos) {
+	text := tr.text()
+	if ap.lastProto == tr.leaf && ap.lastAction == action && tr.leaf.Type == html.TextNode && text != "" && posEqual(ap.lastPos, tr.pos) &&
+		sameLeaf(ap.lastOther, other) {
 		ap.lastText += text
 		return
 	}
-	ap.flush0(action, tr.leaf, tr.pos)
+	ap.flush0(action, tr.leaf, tr.pos, other)
 	if tr.leaf.Type == html.TextNode { // reload the buffer
 		ap.lastText = text
 		return
 	}
-	ap.append0(action, "", tr.leaf, tr.pos)
+	ap.append0(action, "", tr.leaf, tr.pos, other)
+}
+
+// sameLeaf returns true if both treeRunes are nil, or both are in the same leaf at the same position.
+func sameLeaf(a, b *treeRune) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.leaf == b.leaf && posEqual(a.pos, b.pos)
+}
+
+// otherRune returns the treeRune at idx, if there is one.
+func otherRune(trs []treeRune, idx int) *treeRune {
+	if idx >= len(trs) {
+		return nil
+	}
+	return &trs[idx]
 }
 
 func (ap *appendContext) flush() {
-	ap.flush0(0, nil, nil)
+	ap.flush0(0, nil, nil, nil)
 }
 
-func (ap *appendContext) flush0(action rune, proto *html.Node, pos posT) {
+func (ap *appendContext) flush0(action rune, proto *html.Node, pos posT, other *treeRune) {
 	if ap.lastText != "" {
-		ap.append0(ap.lastAction, ap.lastText, ap.lastProto, ap.lastPos) // flush the buffer
+		ap.append0(ap.lastAction, ap.lastText, ap.lastProto, ap.lastPos, ap.lastOther) // flush the buffer
 	}
 	// reset the buffer
 	ap.lastProto = proto
 	ap.lastAction = action
 	ap.lastPos = pos
+	ap.lastOther = other
 	ap.lastText = ""
 }
 
 // append0 builds up the editList of things to do.
-func (ap *appendContext) append0(action rune, text string, proto *html.Node, pos posT) {
+func (ap *appendContext) append0(action rune, text string, proto *html.Node, pos posT, other *treeRune) {
 	os := len(ap.editList)
-	ap.editList = append(ap.editList, editEntry{action, text, proto, pos, os})
+	e := editEntry{action: action, text: text, proto: proto, pos: pos, origSeq: os}
+	if other != nil {
+		e.other, e.otherPos = other.leaf, other.pos
+	}
+	ap.editList = append(ap.editList, e)
+}
+
+// build writes the sorted editList into a new HTML node tree in ap.target using append1.
+// Returns ctx.Err() if ctx is done before all the edits are written.
+func (ap *appendContext) build(ctx context.Context) error {
+	var err error
+	ap.target, err = html.Parse(strings.NewReader("<html><head></head><body></body></html>"))
+	if err != nil {
+		return err
+	}
+	ap.targetBody = nil
+	ap.sources = make(map[*html.Node][]*html.Node)
+	for i, e := range ap.editList {
+		if i%cancelCheckInterval == 0 && ctx.Err() != nil {
+			return ctx.Err()
+		}
+		ap.append1(e)
+	}
+	return nil
+}
+
+// render builds the merged HTML node tree, then renders the body of that tree.
+func (ap *appendContext) render(ctx context.Context) (string, error) {
+	var mergedHTML bytes.Buffer
+	if err := ap.renderTo(ctx, &mergedHTML); err != nil {
+		return "", err
+	}
+	return mergedHTML.String(), nil
+}
+
+// renderTo builds the merged HTML node tree, then writes the contents of the body of that tree to w.
+func (ap *appendContext) renderTo(ctx context.Context, w io.Writer) error {
+	if err := ap.build(ctx); err != nil {
+		return err
+	}
+	return ap.c.renderBody(w, findBody(ap.target))
 }
 
-// Sort the editList before using append1 on all the sorted edits.
-// Sorting is required in order to get edits inside containers in the right order.
-func (ap *appendContext) sortAndWrite() {
-	sort.Stable(ap)
-	for _, e := range ap.editList {
-		ap.append1(e.action, e.text, e.proto, e.pos)
+// numberChanges gives an id to each change in the sorted editList, consecutive entries with the same action within the same
+// block-level element share an id, as do the places where text was moved from and to.
+func (ap *appendContext) numberChanges() {
+	id := 0
+	var lastAction rune
+	var lastBlock *html.Node
+	moveIDs := make(map[int]int) // the id of each move, given where it is first found
+	for i, e := range ap.editList {
+		switch {
+		case e.action == '=':
+		case e.move > 0:
+			if moveIDs[e.move] == 0 {
+				id++
+				moveIDs[e.move] = id
+			}
+			ap.editList[i].id = moveIDs[e.move]
+		default:
+			if e.action != lastAction || editBlock(e) != lastBlock {
+				id++
+			}
+			ap.editList[i].id = id
+		}
+		lastAction, lastBlock = e.action, editBlock(e)
 	}
 }
 
-// append1 actually appends to the merged HTML node tree.
-func (ap *appendContext) append1(action rune, text string, proto *html.Node, pos posT) {
+// append1 actually appends an edit to the merged HTML node tree.
+func (ap *appendContext) append1(e editEntry) {
+	action, text, proto, pos := e.action, e.text, e.proto, e.pos
 	if proto == nil {
 		return
 	}
@@ -138,29 +231,47 @@ func (ap *appendContext) append1(action rune, text string, proto *html.Node, pos
 		newLeaf.Data = text
 	}
 	if action != '=' {
-		insertNode := &html.Node{
-			Type:     html.ElementNode,
-			DataAtom: atom.Span,
-			Data:     "span",
+		var insertNode *html.Node
+		if ap.revisions != nil {
+			insertNode = ap.blameNode(e)
+		} else {
+			insertNode = ap.c.changeNode(action, e.id)
 		}
-		switch action {
-		case '+':
-			insertNode.Attr = convertAttributes(ap.c.InsertedSpan)
-		case '-':
-			insertNode.Attr = convertAttributes(ap.c.DeletedSpan)
-		case '~':
-			insertNode.Attr = convertAttributes(ap.c.ReplacedSpan)
+		if action == '~' && e.other != nil {
+			if ap.c.ShowFormatChanges {
+				addFormatChanges(insertNode, formatChanges(e.other, proto))
+			}
+			if ap.c.ShowAttrChanges {
+				addAttrChanges(insertNode, attrChanges(e.other, proto))
+			}
 		}
 		insertNode.AppendChild(newLeaf)
 		newLeaf = insertNode
 	}
+	if proto.Type == html.ElementNode {
+		ap.sources[newLeaf] = []*html.Node{proto}
+	}
 	for proto = proto.Parent; proto != nil && proto != protoAncestor; proto = proto.Parent {
 		above := new(html.Node)
 		copyNode(above, proto)
 		above.AppendChild(newLeaf)
 		newLeaf = above
+		ap.sources[above] = []*html.Node{proto}
 	}
 	appendPoint.AppendChild(newLeaf)
+	if srcs, found := ap.sources[appendPoint]; found && !containsNode(srcs, protoAncestor) {
+		ap.sources[appendPoint] = append(srcs, protoAncestor)
+	}
+}
+
+// containsNode returns true if the node is in the list.
+func containsNode(nodes []*html.Node, n *html.Node) bool {
+	for _, nn := range nodes {
+		if nn == n {
+			return true
+		}
+	}
+	return false
 }
 
 // find the append point in the merged HTML and from where to copy in the source.
@@ -181,7 +292,7 @@ func (ap *appendContext) lastMatchingLeaf(proto *html.Node, action rune, pos pos
 				break
 			}
 			gpb := getPos(anc) // what we are adding in
-			if ap.leavesEqual(can, anc, action, gpa, gpb) {
+			if ap.leavesEqual(can, anc, action, gpa, gpb) && ap.canJoin(can, anc) {
 				return can, anc
 			}
 		}
@@ -219,3 +330,29 @@ func (ap *appendContext) leavesEqual(a, b *html.Node, action rune, gpa, gpb posT
 	}
 	return true
 }
+
+// canJoin returns true if the element of a version may be joined with an element in the target, given the elements it was made from,
+// so that (for example) two paragraphs are not written as one.
+func (ap *appendContext) canJoin(target, n *html.Node) bool {
+	for _, src := range ap.sources[target] {
+		if !ap.sameElement(src, n) {
+			return false
+		}
+	}
+	return true
+}
+
+// sameElement returns true if two elements, from the same or different versions, may be treated as the same element.
+// Unless the pairs of elements with text in common are known, as for Resolve and Merge, any elements may be (as for HTMLdiff),
+// or for strictPairs none. Otherwise, elements of the same version must be the same element, see nodePairs.sameElement().
+func (ap *appendContext) sameElement(a, b *html.Node) bool {
+	switch {
+	case a == b:
+		return true
+	case ap.pairs == nil:
+		return !ap.strictPairs
+	case treeRoot(a) == treeRoot(b):
+		return false
+	}
+	return ap.pairs.sameElement(a, b, ap.strictPairs)
+}
@@ -0,0 +1,131 @@
+package htmldiff
+
+import (
+	"fmt"
+	"strings"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// AttrChange describes a change to an attribute of one of the elements containing the text of a Replaced Change.
+type AttrChange struct {
+	Element  string // the name of the element, for example "a"
+	Key      string // the name of the attribute, for example "href"
+	Old, New string // the values before and after, Old is empty if the attribute was added and New is empty if it was removed
+	Added    bool
+	Removed  bool
+}
+
+// String describes the attribute change in English.
+func (ac AttrChange) String() string {
+	switch {
+	case ac.Added:
+		return fmt.Sprintf("%s %s added %q", ac.Element, ac.Key, ac.New)
+	case ac.Removed:
+		return fmt.Sprintf("%s %s removed %q", ac.Element, ac.Key, ac.Old)
+	}
+	return fmt.Sprintf("%s %s changed from %q to %q", ac.Element, ac.Key, ac.Old, ac.New)
+}
+
+// attrChanges finds the changes in the attributes of the elements with the same names, from the body down to the old leaf and down to the new leaf.
+func attrChanges(oldLeaf, newLeaf *html.Node) []AttrChange {
+	oldChain, newChain := elementChain(oldLeaf), elementChain(newLeaf)
+	var ret []AttrChange
+	for i, o := range matchChains(oldChain, newChain) {
+		if o >= 0 {
+			ret = append(ret, elementAttrChanges(oldChain[o], newChain[i])...)
+		}
+	}
+	return ret
+}
+
+// matchChains gives, for each element of the new chain, the index of the element with the same name in the old chain, or -1 if there is none.
+// The matches are found in order, so an element may only match one later than the previous match.
+func matchChains(oldChain, newChain []*html.Node) []int {
+	matched := make([]int, len(newChain))
+	o := 0
+	for i, n := range newChain {
+		matched[i] = -1
+		for j := o; j < len(oldChain); j++ {
+			if oldChain[j].Data == n.Data && oldChain[j].Namespace == n.Namespace {
+				matched[i] = j
+				o = j + 1
+				break
+			}
+		}
+	}
+	return matched
+}
+
+// elementChain gives the elements from within the body down to the leaf.
+func elementChain(leaf *html.Node) []*html.Node {
+	var chain []*html.Node
+	for n := leaf; n != nil; n = n.Parent {
+		if n.Type == html.ElementNode {
+			if n.DataAtom == atom.Body || n.DataAtom == atom.Html {
+				break
+			}
+			chain = append([]*html.Node{n}, chain...)
+		}
+	}
+	return chain
+}
+
+// elementAttrChanges finds the changes in the attributes of an element.
+func elementAttrChanges(oldElement, newElement *html.Node) []AttrChange {
+	var ret []AttrChange
+	for _, oa := range oldElement.Attr {
+		ac := AttrChange{Element: newElement.Data, Key: oa.Key, Old: oa.Val, Removed: true}
+		for _, na := range newElement.Attr {
+			if na.Key == oa.Key && na.Namespace == oa.Namespace {
+				ac.New, ac.Removed = na.Val, false
+				break
+			}
+		}
+		if ac.Removed || ac.Old != ac.New {
+			ret = append(ret, ac)
+		}
+	}
+	for _, na := range newElement.Attr {
+		added := true
+		for _, oa := range oldElement.Attr {
+			if na.Key == oa.Key && na.Namespace == oa.Namespace {
+				added = false
+				break
+			}
+		}
+		if added {
+			ret = append(ret, AttrChange{Element: newElement.Data, Key: na.Key, New: na.Val, Added: true})
+		}
+	}
+	return ret
+}
+
+// addAttrChanges adds a title describing the attribute changes to the element wrapping a Replaced change,
+// along with data-old-* attributes giving the old values of the attributes which were changed or removed.
+// Where several elements change the same attribute, the data-old-* attribute gives the old value for the innermost one.
+func addAttrChanges(n *html.Node, changes []AttrChange) {
+	if len(changes) == 0 {
+		return
+	}
+	descriptions := make([]string, 0, len(changes))
+	for _, ac := range changes {
+		descriptions = append(descriptions, ac.String())
+		if !ac.Added {
+			setAttr(n, "data-old-"+ac.Key, ac.Old)
+		}
+	}
+	addTitle(n, strings.Join(descriptions, "; "))
+}
+
+// setAttr sets an attribute of an element, replacing any existing value.
+func setAttr(n *html.Node, key, val string) {
+	for i := range n.Attr {
+		if n.Attr[i].Key == key && n.Attr[i].Namespace == "" {
+			n.Attr[i].Val = val
+			return
+		}
+	}
+	n.Attr = append(n.Attr, html.Attribute{Key: key, Val: val})
+}
@@ -26,3 +26,16 @@ func BenchmarkHTMLdiff(b *testing.B) {
 		}
 	}
 }
+
+func BenchmarkHTMLdiffHierarchical(b *testing.B) {
+	hierCfg := *cfgBench
+	hierCfg.Hierarchical = true
+	bbc := bbcNews1 + bbcNews2
+	args := []string{bbc, bbcNews1 + "<div><i>HTML-Diff-Inserted</i></div>" + bbcNews2}
+	for n := 0; n < b.N; n++ {
+		_, err := hierCfg.HTMLdiff(args) // don't care about the result as we are looking at speed
+		if err != nil {
+			b.Errorf("comparing BBC news with an inserted div error: %s", err)
+		}
+	}
+}
@@ -0,0 +1,173 @@
+package htmldiff
+
+import (
+	"context"
+	"sort"
+	"strconv"
+
+	"github.com/mb0/diff"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// Revision is a version of the HTML, with the name of its author, for Blame.
+type Revision struct {
+	HTML   string
+	Author string
+}
+
+// Blame merges all of the revisions of the HTML into one snippit, from revisions[0] onwards, showing who wrote what.
+// Each fragment of text still present in the last revision is wrapped in a span tag with the data-revision and data-author
+// of the revision which introduced it. Each fragment deleted on the way is also included, wrapped in a span tag with the DeletedSpan
+// attributes, plus the data-revision and data-author which introduced it and the data-deleted-revision and data-deleted-author which removed it.
+// The revisions are numbered from zero.
+func (c *Config) Blame(revisions []Revision) (string, error) {
+	return c.BlameContext(context.Background(), revisions)
+}
+
+// BlameContext is the same as Blame, except that the work stops as soon as ctx is done, returning ctx.Err().
+func (c *Config) BlameContext(ctx context.Context, revisions []Revision) (string, error) {
+	if len(revisions) < 2 {
+		return "", errTooFewVersions
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel() // on error return, stop any work still in progress
+	versions := make([]Version, len(revisions))
+	for r, rr := range revisions {
+		versions[r] = StringVersion(rr.HTML)
+	}
+	sources, err := c.parseVersions(ctx, versions)
+	if err != nil {
+		return "", err
+	}
+
+	edits := make([][]diff.Change, len(revisions)-1)
+	err = c.parallel(ctx, len(edits), func(ctx context.Context, e int) (err error) {
+		edits[e], _, err = c.diffSources(ctx, sources[e], sources[e+1])
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+
+	items := make([]blameItem, len(*sources[0].treeRunes))
+	for i := range items {
+		items[i].idx = i
+	}
+	for e, changes := range edits {
+		if err := ctx.Err(); err != nil {
+			return "", err
+		}
+		items = blameRevision(items, changes, e+1, len(*sources[e].treeRunes), len(*sources[e+1].treeRunes))
+	}
+
+	app := &appendContext{c: c, revisions: revisions}
+	start := 0
+	var last *blameItem
+	for i := range items {
+		if i%cancelCheckInterval == 0 && ctx.Err() != nil {
+			return "", ctx.Err()
+		}
+		item := &items[i]
+		if item.idx < sources[item.rev].firstLeaf {
+			continue
+		}
+		if last != nil && (item.introduced != last.introduced || item.removed != last.removed) {
+			app.flush()
+			start = app.setRevisions(start, last)
+		}
+		action := '+'
+		if item.removed > 0 {
+			action = '-'
+		}
+		app.append(action, *sources[item.rev].treeRunes, item.idx, nil)
+		last = item
+	}
+	if last != nil {
+		app.flush()
+		app.setRevisions(start, last)
+	}
+	sort.Stable(app)
+	return app.render(ctx)
+}
+
+// blameItem is a treeRune from one of the revisions, with the revisions which introduced and removed it.
+type blameItem struct {
+	rev, idx            int // the revision of the treeRune and its index, the last revision in which it was present
+	introduced, removed int // removed is zero while it is still present
+}
+
+// blameRevision moves the items on to revision rev, given the changes from the previous revision,
+// which had prevLen treeRunes, where the revision has revLen treeRunes.
+func blameRevision(items []blameItem, changes []diff.Change, rev, prevLen, revLen int) []blameItem {
+	same := make([]int, prevLen) // the index in the revision of each treeRune in the previous revision, or -1 if deleted
+	insertBefore := make([][]int, prevLen+1)
+	aIdx, bIdx := 0, 0
+	for _, change := range changes {
+		for ; aIdx < change.A && bIdx < revLen; aIdx, bIdx = aIdx+1, bIdx+1 {
+			same[aIdx] = bIdx
+		}
+		for i := 0; i < change.Del && aIdx < prevLen; i, aIdx = i+1, aIdx+1 {
+			same[aIdx] = -1
+		}
+		for i := 0; i < change.Ins && bIdx < revLen; i, bIdx = i+1, bIdx+1 {
+			insertBefore[aIdx] = append(insertBefore[aIdx], bIdx)
+		}
+	}
+	for ; aIdx < prevLen && bIdx < revLen; aIdx, bIdx = aIdx+1, bIdx+1 {
+		same[aIdx] = bIdx
+	}
+	for ; aIdx < prevLen; aIdx++ {
+		same[aIdx] = -1
+	}
+
+	ret := make([]blameItem, 0, len(items)+revLen-prevLen)
+	inserted := func(a int) {
+		for _, b := range insertBefore[a] {
+			ret = append(ret, blameItem{rev: rev, idx: b, introduced: rev})
+		}
+	}
+	for _, item := range items {
+		if item.removed == 0 {
+			inserted(item.idx)
+			if same[item.idx] < 0 {
+				item.removed = rev
+			} else {
+				item.rev, item.idx = rev, same[item.idx]
+			}
+		}
+		ret = append(ret, item)
+	}
+	inserted(prevLen)
+	return ret
+}
+
+// setRevisions gives the revisions of the item to the edits in the editList from start, returning the new start.
+func (ap *appendContext) setRevisions(start int, item *blameItem) int {
+	for i := start; i < len(ap.editList); i++ {
+		ap.editList[i].introduced, ap.editList[i].removed = item.introduced, item.removed
+	}
+	return len(ap.editList)
+}
+
+// blameNode returns a new element to wrap an edit made by Blame.
+func (ap *appendContext) blameNode(e editEntry) *html.Node {
+	n := &html.Node{
+		Type:     html.ElementNode,
+		DataAtom: atom.Span,
+		Data:     "span",
+	}
+	if e.action == '-' {
+		n.Attr = convertAttributes(ap.c.DeletedSpan)
+	}
+	n.Attr = append(n.Attr,
+		html.Attribute{Key: "data-revision", Val: strconv.Itoa(e.introduced)},
+		html.Attribute{Key: "data-author", Val: ap.revisions[e.introduced].Author})
+	if e.action == '-' {
+		n.Attr = append(n.Attr,
+			html.Attribute{Key: "data-deleted-revision", Val: strconv.Itoa(e.removed)},
+			html.Attribute{Key: "data-deleted-author", Val: ap.revisions[e.removed].Author})
+	}
+	return n
+}
@@ -0,0 +1,206 @@
+package htmldiff
+
+import (
+	"context"
+	"hash/fnv"
+
+	"github.com/mb0/diff"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// segment is a run of treeRunes within the same block-level element (or the same leaf, if not in a block).
+type segment struct {
+	start, end int    // the range of treeRunes in the segment
+	hash       uint64 // of the content of the treeRunes, see segmentHash()
+}
+
+// isBlock returns true for the block-level elements whose content is compared as a whole.
+func isBlock(n *html.Node) bool {
+	if n.Type != html.ElementNode {
+		return false
+	}
+	switch n.DataAtom {
+	case atom.P, atom.Li, atom.Tr, atom.H1, atom.H2, atom.H3, atom.H4, atom.H5, atom.H6, atom.Div,
+		atom.Pre, atom.Blockquote, atom.Dt, atom.Dd, atom.Caption, atom.Address, atom.Figure,
+		atom.Section, atom.Article, atom.Aside, atom.Header, atom.Footer, atom.Nav:
+		return true
+	}
+	return false
+}
+
+// blockOf returns the innermost block-level element containing the leaf, or the leaf itself if there is none.
+func blockOf(leaf *html.Node) *html.Node {
+	for n := leaf.Parent; n != nil; n = n.Parent {
+		if isBlock(n) {
+			return n
+		}
+	}
+	return leaf
+}
+
+// segmentTreeRunes splits the treeRunes into segments, so that they can be compared block by block.
+func segmentTreeRunes(tr []treeRune) []segment {
+	var segs []segment
+	var lastBlock *html.Node
+	for i, r := range tr {
+		block := blockOf(r.leaf)
+		if i == 0 || block != lastBlock {
+			if i > 0 {
+				segs[len(segs)-1].end = i
+			}
+			segs = append(segs, segment{start: i})
+			lastBlock = block
+		}
+	}
+	if len(segs) > 0 {
+		segs[len(segs)-1].end = len(tr)
+	}
+	for s := range segs {
+		segs[s].hash = segmentHash(tr[segs[s].start:segs[s].end])
+	}
+	return segs
+}
+
+// segments returns the segments of the source, using those prepared in advance if there are any.
+func (s *source) segments() []segment {
+	if s.segs != nil {
+		return s.segs
+	}
+	return segmentTreeRunes(*s.treeRunes)
+}
+
+// prepareSegments segments the source, and its body, in advance, for a source which is compared many times.
+// The source must not be changed, or prepared again, while it is being compared.
+func (s *source) prepareSegments() {
+	body := s.body()
+	body.segs = segmentTreeRunes(*body.treeRunes)
+	s.segs = segmentTreeRunes(*s.treeRunes)
+	s.bodySrc = body
+}
+
+// segmentHash hashes the information that diffData.Equal() compares, for a run of treeRunes.
+func segmentHash(tr []treeRune) uint64 {
+	h := fnv.New64a()
+	buf := make([]byte, 0, 64)
+	var lastLeaf *html.Node
+	for _, r := range tr {
+		buf = buf[:0]
+		if r.leaf != lastLeaf {
+			for n, depth := r.leaf, 0; n != nil && depth < 2; n, depth = n.Parent, depth+1 { // see nodeBranchesEqual()
+				buf = append(buf, byte(n.Type), 0)
+				buf = append(buf, n.DataAtom.String()...)
+				buf = append(buf, 0)
+				buf = append(buf, n.Namespace...)
+				for _, a := range n.Attr {
+					buf = append(buf, 0)
+					buf = append(buf, a.Namespace...)
+					buf = append(buf, 0)
+					buf = append(buf, a.Key...)
+					buf = append(buf, 0)
+					buf = append(buf, a.Val...)
+				}
+				buf = append(buf, 1)
+			}
+			lastLeaf = r.leaf
+		}
+		for _, p := range r.pos {
+			buf = append(buf, byte(p.nodesBefore), byte(p.nodesBefore>>8), byte(p.nodesBefore>>16))
+		}
+		buf = append(buf, byte(r.letter), byte(r.letter>>8), byte(r.letter>>16))
+		buf = append(buf, r.token...)
+		buf = append(buf, 2)
+		h.Write(buf)
+	}
+	return h.Sum64()
+}
+
+// segmentData is a type that exists in order to provide a diff.Data interface. It holds the two sets of segments to difference.
+type segmentData struct {
+	dd         diffData
+	segA, segB []segment
+}
+
+// Equal exists to fulfill the diff.Data interface.
+func (sd segmentData) Equal(i, j int) bool {
+	sd.dd.cancel.check()
+	sa, sb := sd.segA[i], sd.segB[j]
+	if sa.hash != sb.hash || sa.end-sa.start != sb.end-sb.start {
+		return false
+	}
+	for k := 0; k < sa.end-sa.start; k++ {
+		if !sd.dd.Equal(sa.start+k, sb.start+k) {
+			return false
+		}
+	}
+	return true
+}
+
+// treeRuneChanges converts changes in the segments into changes in the treeRunes.
+func (sd segmentData) treeRuneChanges(changes []diff.Change) []diff.Change {
+	ret := make([]diff.Change, 0, len(changes))
+	for _, ch := range changes {
+		ret = append(ret, diff.Change{
+			A:   segmentStart(sd.segA, ch.A, len(*sd.dd.a)),
+			B:   segmentStart(sd.segB, ch.B, len(*sd.dd.b)),
+			Del: segmentStart(sd.segA, ch.A+ch.Del, len(*sd.dd.a)) - segmentStart(sd.segA, ch.A, len(*sd.dd.a)),
+			Ins: segmentStart(sd.segB, ch.B+ch.Ins, len(*sd.dd.b)) - segmentStart(sd.segB, ch.B, len(*sd.dd.b)),
+		})
+	}
+	return ret
+}
+
+// segmentStart gives the index of the first treeRune of segment s, or the number of treeRunes if s is beyond the end.
+func segmentStart(segs []segment, s, treeRuneCount int) int {
+	if s >= len(segs) {
+		return treeRuneCount
+	}
+	return segs[s].start
+}
+
+// diffBlocks finds the differences between two prepared versions of the HTML, comparing whole blocks rather than letters,
+// until the deadline of ctx, see diffSources().
+func (c *Config) diffBlocks(ctx context.Context, a, b *source) ([]diff.Change, error) {
+	sd := segmentData{
+		dd:   diffData{a: a.treeRunes, b: b.treeRunes, cancel: &canceller{ctx: ctx}},
+		segA: a.segments(),
+		segB: b.segments(),
+	}
+	changes, err := diffContext(ctx, len(sd.segA), len(sd.segB), sd)
+	if err != nil {
+		return nil, err
+	}
+	return sd.treeRuneChanges(changes), nil
+}
+
+// diffHierarchical finds the differences between two prepared versions of the HTML,
+// first comparing whole blocks, then comparing letter by letter within the blocks that differ.
+func (c *Config) diffHierarchical(ctx context.Context, a, b *source) ([]diff.Change, error) {
+	sd := segmentData{
+		dd:   diffData{a: a.treeRunes, b: b.treeRunes, cancel: &canceller{ctx: ctx}},
+		segA: a.segments(),
+		segB: b.segments(),
+	}
+	blockChanges, err := diffContext(ctx, len(sd.segA), len(sd.segB), sd)
+	if err != nil {
+		return nil, err
+	}
+	var changes []diff.Change
+	for _, bc := range sd.treeRuneChanges(blockChanges) {
+		if bc.Del == 0 || bc.Ins == 0 { // nothing to compare within
+			changes = append(changes, bc)
+			continue
+		}
+		inner, err := c.diffRange(ctx, (*a.treeRunes)[bc.A:bc.A+bc.Del], (*b.treeRunes)[bc.B:bc.B+bc.Ins])
+		if err != nil {
+			return nil, err
+		}
+		for _, ch := range inner {
+			ch.A += bc.A
+			ch.B += bc.B
+			changes = append(changes, ch)
+		}
+	}
+	return changes, nil
+}
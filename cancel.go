@@ -0,0 +1,70 @@
+package htmldiff
+
+import (
+	"context"
+	"io"
+
+	"github.com/mb0/diff"
+)
+
+// cancelCheckInterval is how many iterations of a loop to perform between checks for cancellation.
+const cancelCheckInterval = 1 << 12
+
+// ctxReader is an io.Reader that stops reading once its context is done, so that html.Parse() can be cancelled.
+type ctxReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+// Read is part of io.Reader.
+func (cr ctxReader) Read(p []byte) (int, error) {
+	if err := cr.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return cr.r.Read(p)
+}
+
+// diffCancelled is panicked from within diff.Diff() to abandon it, as the diff package has no means of cancellation.
+type diffCancelled struct {
+	err error
+}
+
+// canceller is used by the diff.Data implementations to check regularly if the context is done.
+type canceller struct {
+	ctx   context.Context
+	count int
+}
+
+// check panics with diffCancelled if the context is done, so must only be called within diffContext().
+// A nil canceller never cancels.
+func (cn *canceller) check() {
+	if cn == nil {
+		return
+	}
+	cn.count++
+	if cn.count%cancelCheckInterval == 0 {
+		select {
+		case <-cn.ctx.Done():
+			panic(diffCancelled{cn.ctx.Err()})
+		default:
+		}
+	}
+}
+
+// diffContext runs diff.Diff() in the current goroutine, but abandons it returning ctx.Err() once ctx is done,
+// provided that data calls check() on a canceller for ctx.
+func diffContext(ctx context.Context, n, m int, data diff.Data) (changes []diff.Change, err error) {
+	if err = ctx.Err(); err != nil {
+		return nil, err
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			dc, ok := r.(diffCancelled)
+			if !ok {
+				panic(r)
+			}
+			changes, err = nil, dc.err
+		}
+	}()
+	return diff.Diff(n, m, data), nil
+}
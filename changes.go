@@ -0,0 +1,132 @@
+package htmldiff
+
+import (
+	"context"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// Action describes what has happened to a part of the HTML.
+type Action rune
+
+// The actions that a Change can have, which are also the runes used internally.
+const (
+	Unchanged Action = '='
+	Inserted  Action = '+'
+	Deleted   Action = '-'
+	Replaced  Action = '~' // the text is the same, but the formatting has changed
+	MovedFrom Action = '{' // the text has been moved from here to the MovedTo with the same ID, see Config.DetectMoves
+	MovedTo   Action = '}' // the text has been moved here, from the MovedFrom with the same ID
+)
+
+// String returns the name of the Action.
+func (a Action) String() string {
+	switch a {
+	case Unchanged:
+		return "unchanged"
+	case Inserted:
+		return "inserted"
+	case Deleted:
+		return "deleted"
+	case Replaced:
+		return "replaced"
+	case MovedFrom:
+		return "moved from"
+	case MovedTo:
+		return "moved to"
+	}
+	return "unknown"
+}
+
+// Change is a structured description of a part of the merged HTML.
+type Change struct {
+	Action   Action
+	ID       int      // identifies the change, shared by consecutive parts of the same change, zero when Unchanged
+	Old, New string   // the text before and after, only Old for Deleted or MovedFrom and only New for Inserted or MovedTo, empty for elements like <img>
+	Path     []string // the element names from within <body> down to the text or element changed, for example ["ul", "li", "b"]
+	Pos      []int    // for each enclosing container (list or table), outermost first, the number of elements before this one
+
+	Attrs  []AttrChange   // for Replaced, the changes to the attributes of the elements containing the text, if any
+	Format []FormatChange // for Replaced, the elements added or removed around the text, if any
+
+	entry           *editEntry // where the change came from, for Resolve
+	fragmentContext string     // the Config.FragmentContext used to find the change, for Resolve
+	pairs           *nodePairs // the elements which are the same in both versions, for Resolve
+}
+
+// Changes finds all the differences in the versions of HTML snippits, in the same way as HTMLdiff,
+// but returns them as a list of Change records for each edit, in the order they appear in the merged HTML.
+// Unchanged parts are included in the list, so that the changes can be shown in context.
+func (c *Config) Changes(versions []string) ([][]Change, error) {
+	return c.ChangesContext(context.Background(), versions)
+}
+
+// ChangesContext is the same as Changes, except that the work stops as soon as ctx is done, returning ctx.Err().
+func (c *Config) ChangesContext(ctx context.Context, versions []string) ([][]Change, error) {
+	if len(versions) < 2 {
+		return nil, errTooFewVersions
+	}
+	changeLists := make([][]Change, len(versions)-1)
+	err := c.compareVersions(ctx, stringVersions(versions), func(m int, ap *appendContext) error {
+		changeLists[m] = ap.changes()
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return changeLists, nil
+}
+
+// changes converts the editList into Change records.
+func (ap *appendContext) changes() []Change {
+	if ap.pairs == nil {
+		ap.pairEntries() // for Resolve
+	}
+	ret := make([]Change, 0, len(ap.editList))
+	for i, e := range ap.editList {
+		if e.proto == nil {
+			continue
+		}
+		ch := Change{
+			entry:           &ap.editList[i],
+			fragmentContext: ap.c.FragmentContext,
+			pairs:           ap.pairs,
+			Action:          Action(e.action),
+			ID:              e.id,
+			Path:            elementPath(e.proto),
+			Pos:             make([]int, len(e.pos)),
+		}
+		switch ch.Action {
+		case Inserted, MovedTo:
+			ch.New = e.text
+		case Deleted, MovedFrom:
+			ch.Old = e.text
+		default:
+			ch.Old, ch.New = e.text, e.text
+		}
+		if ch.Action == Replaced && e.other != nil {
+			ch.Attrs = attrChanges(e.other, e.proto)
+			ch.Format = formatChanges(e.other, e.proto)
+		}
+		for i, p := range e.pos {
+			ch.Pos[len(e.pos)-1-i] = p.nodesBefore
+		}
+		ret = append(ret, ch)
+	}
+	return ret
+}
+
+// elementPath gives the names of the elements from within the body to the given node.
+func elementPath(n *html.Node) []string {
+	var path []string
+	for ; n != nil; n = n.Parent {
+		if n.Type == html.ElementNode {
+			if n.DataAtom == atom.Body || n.DataAtom == atom.Html {
+				break
+			}
+			path = append([]string{n.Data}, path...)
+		}
+	}
+	return path
+}
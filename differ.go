@@ -0,0 +1,66 @@
+package htmldiff
+
+import "context"
+
+// Differ compares edits with a base version of the HTML, which is parsed and prepared only once.
+// It is safe for concurrent use by multiple goroutines, as the prepared base is not changed by the comparisons.
+type Differ struct {
+	c    Config // a copy, so that the base is always compared in the way it was prepared
+	base *source
+}
+
+// NewDiffer parses and prepares the base version of the HTML, for comparison with many edits.
+func (c *Config) NewDiffer(base string) (*Differ, error) {
+	return c.NewDifferContext(context.Background(), StringVersion(base))
+}
+
+// NewDifferContext is the same as NewDiffer, except that the base may be any Version, and the parsing stops as soon as ctx is done, returning ctx.Err().
+func (c *Config) NewDifferContext(ctx context.Context, base Version) (*Differ, error) {
+	d := &Differ{c: *c}
+	var err error
+	d.base, err = d.c.parseVersion(ctx, base)
+	if err != nil {
+		return nil, err
+	}
+	if d.c.Hierarchical || d.c.Fallback >= FallbackBlocks {
+		d.base.prepareSegments() // so that the base is not segmented again for every edit
+	}
+	return d, nil
+}
+
+// HTMLdiff finds the differences between the base and an edit, returning the merged HTML snippit, as Config.HTMLdiff would.
+func (d *Differ) HTMLdiff(edit string) (string, error) {
+	return d.HTMLdiffContext(context.Background(), StringVersion(edit))
+}
+
+// HTMLdiffContext is the same as HTMLdiff, except that the edit may be any Version, and the work stops as soon as ctx is done, returning ctx.Err().
+func (d *Differ) HTMLdiffContext(ctx context.Context, edit Version) (string, error) {
+	ap, err := d.compare(ctx, edit)
+	if err != nil {
+		return "", err
+	}
+	return ap.render(ctx)
+}
+
+// Changes finds the differences between the base and an edit, returning them as a list of Change records, as Config.Changes would.
+func (d *Differ) Changes(edit string) ([]Change, error) {
+	return d.ChangesContext(context.Background(), StringVersion(edit))
+}
+
+// ChangesContext is the same as Changes, except that the edit may be any Version, and the work stops as soon as ctx is done, returning ctx.Err().
+func (d *Differ) ChangesContext(ctx context.Context, edit Version) ([]Change, error) {
+	ap, err := d.compare(ctx, edit)
+	if err != nil {
+		return nil, err
+	}
+	return ap.changes(), nil
+}
+
+// compare parses and prepares an edit, then compares it with the base.
+func (d *Differ) compare(ctx context.Context, edit Version) (*appendContext, error) {
+	src, err := d.c.parseVersion(ctx, edit)
+	if err != nil {
+		return nil, err
+	}
+	return d.c.compare(ctx, d.base, src)
+}
@@ -0,0 +1,220 @@
+package htmldiff
+
+import (
+	"bytes"
+	"context"
+	"strings"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// HeadChange describes a difference in the <head> of two versions of an HTML document.
+type HeadChange struct {
+	Action   Action // Inserted, Deleted or Replaced (when the content, href or src has changed)
+	Element  string // the name of the element in the head, for example "title", "meta", "link" or "script"
+	Key      string // what the element is about: the name (or property, http-equiv or charset) of a meta, the rel of a link or "src" for a script file
+	Old, New string // the content of a title or meta, the href of a link or the src (or text) of a script, only Old for Deleted and only New for Inserted
+}
+
+// DocumentResult holds the merged HTML document for an edit, along with a summary of the changes to its <head>.
+type DocumentResult struct {
+	HTML     string       // a complete HTML document, with the head of the edit and the merged body
+	Head     []HeadChange // the changes to the head, in the order they appear in the edit (deletions in the order they appear in the base)
+	Fallback Fallback     // if not NoFallback, then the merged body is less precise than usual
+}
+
+// HTMLdiffDocuments finds all the differences in the versions of complete HTML documents, in the same way as HTMLdiff,
+// but also compares the metadata in the <head> of each document, such as the title, meta tags and linked stylesheets and scripts.
+// The results are complete HTML documents, with the head of each edit, rather than snippits.
+func (c *Config) HTMLdiffDocuments(versions []string) ([]DocumentResult, error) {
+	return c.HTMLdiffDocumentsContext(context.Background(), versions)
+}
+
+// HTMLdiffDocumentsContext is the same as HTMLdiffDocuments, except that the work stops as soon as ctx is done, returning ctx.Err().
+func (c *Config) HTMLdiffDocumentsContext(ctx context.Context, versions []string) ([]DocumentResult, error) {
+	if len(versions) < 2 {
+		return nil, errTooFewVersions
+	}
+	dc := *c
+	dc.bodiesOnly = true
+	results := make([]DocumentResult, len(versions)-1)
+	err := dc.compareVersions(ctx, stringVersions(versions), func(m int, ap *appendContext) (err error) {
+		results[m].Fallback = ap.fallback
+		results[m].Head = headChanges(headItems(ap.base.tree), headItems(ap.edit.tree))
+		results[m].HTML, err = ap.renderDocument(ctx)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+// renderDocument builds the merged HTML node tree, then renders it as a complete document with the doctype,
+// the head and the attributes of the <html> and <body> elements of the edit.
+func (ap *appendContext) renderDocument(ctx context.Context) (string, error) {
+	err := ap.build(ctx)
+	if err != nil {
+		return "", err
+	}
+	targetHTML := ap.target.FirstChild
+	targetHead, targetBody := targetHTML.FirstChild, findBody(ap.target)
+	for n := ap.edit.tree.FirstChild; n != nil; n = n.NextSibling {
+		switch {
+		case n.Type == html.DoctypeNode:
+			ap.target.InsertBefore(cloneNode(n), targetHTML)
+		case n.Type == html.ElementNode && n.DataAtom == atom.Html:
+			targetHTML.Attr = n.Attr
+			for ch := n.FirstChild; ch != nil; ch = ch.NextSibling {
+				if ch.Type == html.ElementNode && ch.DataAtom == atom.Head {
+					for targetHead.FirstChild != nil { // remove anything the merge put in the head
+						targetHead.RemoveChild(targetHead.FirstChild)
+					}
+					targetHead.Attr = ch.Attr
+					for hc := ch.FirstChild; hc != nil; hc = hc.NextSibling {
+						targetHead.AppendChild(cloneNode(hc))
+					}
+				}
+			}
+		}
+	}
+	if body := findBody(ap.edit.tree); body != nil {
+		targetBody.Attr = body.Attr
+	}
+	var buf bytes.Buffer
+	err = html.Render(&buf, ap.target)
+	if err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// cloneNode makes a deep copy of a node and its children.
+func cloneNode(n *html.Node) *html.Node {
+	ret := new(html.Node)
+	copyNode(ret, n)
+	for ch := n.FirstChild; ch != nil; ch = ch.NextSibling {
+		ret.AppendChild(cloneNode(ch))
+	}
+	return ret
+}
+
+// headItem is the metadata from an element in the <head> of a document.
+type headItem struct {
+	element, key, val string
+	keyed             bool // if true, items with the same element and key are the same item, otherwise the val must also be the same
+}
+
+// match gives what must be the same for two headItems to be the same item.
+func (hi headItem) match() string {
+	if hi.keyed {
+		return hi.element + "\x00" + hi.key
+	}
+	return hi.element + "\x00" + hi.key + "\x00" + hi.val
+}
+
+// headItems finds the metadata in the <head> of a document.
+func headItems(doc *html.Node) []headItem {
+	var head *html.Node
+	for n := doc.FirstChild; n != nil && head == nil; n = n.NextSibling {
+		if n.Type == html.ElementNode && n.DataAtom == atom.Html {
+			for ch := n.FirstChild; ch != nil; ch = ch.NextSibling {
+				if ch.Type == html.ElementNode && ch.DataAtom == atom.Head {
+					head = ch
+					break
+				}
+			}
+		}
+	}
+	if head == nil {
+		return nil
+	}
+	var items []headItem
+	for n := head.FirstChild; n != nil; n = n.NextSibling {
+		if n.Type != html.ElementNode {
+			continue
+		}
+		hi := headItem{element: n.Data}
+		switch n.DataAtom {
+		case atom.Title:
+			hi.val, hi.keyed = strings.TrimSpace(nodeText(n)), true
+		case atom.Base:
+			hi.val, hi.keyed = getAttr(n, "href"), true
+		case atom.Meta:
+			hi.keyed = true
+			for _, k := range []string{"name", "property", "http-equiv", "itemprop"} {
+				if v := getAttr(n, k); v != "" {
+					hi.key, hi.val = v, getAttr(n, "content")
+					break
+				}
+			}
+			if v := getAttr(n, "charset"); v != "" && hi.key == "" {
+				hi.key, hi.val = "charset", v
+			}
+		case atom.Link:
+			hi.key, hi.val = getAttr(n, "rel"), getAttr(n, "href")
+		case atom.Script:
+			if src := getAttr(n, "src"); src != "" {
+				hi.key, hi.val = "src", src
+			} else {
+				hi.val = strings.TrimSpace(nodeText(n))
+			}
+		default:
+			hi.val = strings.TrimSpace(nodeText(n))
+		}
+		items = append(items, hi)
+	}
+	return items
+}
+
+// headChanges compares the metadata in the <head> of two documents.
+func headChanges(base, edit []headItem) []HeadChange {
+	unmatched := make(map[string][]int) // the base items not yet matched, in order
+	for i, hi := range base {
+		unmatched[hi.match()] = append(unmatched[hi.match()], i)
+	}
+	matched := make([]bool, len(base))
+	var ret []HeadChange
+	for _, hi := range edit {
+		m := hi.match()
+		if len(unmatched[m]) == 0 {
+			ret = append(ret, HeadChange{Action: Inserted, Element: hi.element, Key: hi.key, New: hi.val})
+			continue
+		}
+		b := base[unmatched[m][0]]
+		matched[unmatched[m][0]] = true
+		unmatched[m] = unmatched[m][1:]
+		if b.val != hi.val {
+			ret = append(ret, HeadChange{Action: Replaced, Element: hi.element, Key: hi.key, Old: b.val, New: hi.val})
+		}
+	}
+	for i, hi := range base {
+		if !matched[i] {
+			ret = append(ret, HeadChange{Action: Deleted, Element: hi.element, Key: hi.key, Old: hi.val})
+		}
+	}
+	return ret
+}
+
+// getAttr returns the value of an attribute of an element, or "" if it has no such attribute.
+func getAttr(n *html.Node, key string) string {
+	for _, a := range n.Attr {
+		if a.Namespace == "" && strings.ToLower(a.Key) == key {
+			return a.Val
+		}
+	}
+	return ""
+}
+
+// nodeText returns the text within a node.
+func nodeText(n *html.Node) string {
+	if n.Type == html.TextNode {
+		return n.Data
+	}
+	var text string
+	for ch := n.FirstChild; ch != nil; ch = ch.NextSibling {
+		text += nodeText(ch)
+	}
+	return text
+}
@@ -0,0 +1,52 @@
+package htmldiff
+
+import (
+	"bytes"
+	"context"
+	"io"
+
+	"golang.org/x/net/html/charset"
+	"golang.org/x/text/encoding/unicode"
+	"golang.org/x/text/transform"
+)
+
+// BytesVersion returns a Version of the HTML held in b, which may be in any character encoding.
+// The encoding is found from a byte order mark, a <meta> charset or Content-Type, or by looking at the content,
+// in the same way as a browser, so each version may be in a different encoding.
+// As such a version is usually a whole document, with a <meta> charset in its head, only its body is compared.
+// The bytes are decoded afresh each time the version is parsed, so the Version may be used many times, but b must not change.
+func BytesVersion(b []byte) Version {
+	return Version{b: b, bodyOnly: true}
+}
+
+// decodeBytes returns a reader of the bytes of a BytesVersion, converted to UTF-8 from the encoding found.
+func decodeBytes(b []byte) io.Reader {
+	e, _, _ := charset.DetermineEncoding(b, "")
+	return transform.NewReader(bytes.NewReader(b), unicode.BOMOverride(e.NewDecoder()))
+}
+
+// HTMLdiffBytes is the same as HTMLdiff, except that the versions are given as bytes in any character encoding, see BytesVersion.
+// The resulting merged HTML snippits are UTF-8.
+func (c *Config) HTMLdiffBytes(versions [][]byte) ([]string, error) {
+	return c.HTMLdiffBytesContext(context.Background(), versions)
+}
+
+// HTMLdiffBytesContext is the same as HTMLdiffBytes, except that the work stops as soon as ctx is done, returning ctx.Err().
+func (c *Config) HTMLdiffBytesContext(ctx context.Context, versions [][]byte) ([]string, error) {
+	if len(versions) < 2 {
+		return nil, errTooFewVersions
+	}
+	vv := make([]Version, len(versions))
+	for v, b := range versions {
+		vv[v] = BytesVersion(b)
+	}
+	mergedHTMLs := make([]string, len(versions)-1)
+	err := c.compareVersions(ctx, vv, func(m int, ap *appendContext) (err error) {
+		mergedHTMLs[m], err = ap.render(ctx)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return mergedHTMLs, nil
+}
@@ -6,7 +6,7 @@ import (
 	"github.com/documize/html-diff"
 )
 
-func ExampleHTMLdiff() {
+func ExampleConfig_HTMLdiff() {
 	previousHTML := `<p>Bullet list:</p><ul><li>first item</li><li>第二</li><li>3rd</li></ul>`
 	latestHTML := `<p>Bullet <b>list:</b></p><ul><li>first item</li><li>number two</li><li>3rd</li></ul>`
 	var cfg = &htmldiff.Config{
@@ -0,0 +1,100 @@
+package htmldiff
+
+import (
+	"strings"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// FormatChange describes an element added or removed around the text of a Replaced Change.
+type FormatChange struct {
+	Element string // the name of the element, for example "b"
+	Added   bool   // true if the text is now within the element, false if it no longer is
+}
+
+// the names of the inline formatting elements, as used in a FormatChange description.
+var formatNames = map[atom.Atom]string{
+	atom.B: "bold", atom.Strong: "bold",
+	atom.I: "italic", atom.Em: "italic", atom.Cite: "italic",
+	atom.U: "underline", atom.Ins: "underline",
+	atom.S: "strikethrough", atom.Strike: "strikethrough", atom.Del: "strikethrough",
+	atom.Sub: "subscript", atom.Sup: "superscript",
+	atom.Code: "code", atom.Tt: "code", atom.Kbd: "code", atom.Samp: "code",
+	atom.Mark: "highlight", atom.A: "link",
+}
+
+// String describes the formatting change in English, for example "bold added" or "moved into h1".
+func (fc FormatChange) String() string {
+	a := atom.Lookup([]byte(fc.Element))
+	if name, ok := formatNames[a]; ok {
+		if fc.Added {
+			return name + " added"
+		}
+		return name + " removed"
+	}
+	if n := (&html.Node{Type: html.ElementNode, DataAtom: a}); isBlock(n) || inContainer(n) {
+		if fc.Added {
+			return "moved into " + fc.Element
+		}
+		return "moved out of " + fc.Element
+	}
+	if fc.Added {
+		return fc.Element + " added"
+	}
+	return fc.Element + " removed"
+}
+
+// formatChanges finds the elements added and removed around the text, comparing the elements from the body down to
+// the old leaf with those down to the new leaf.
+func formatChanges(oldLeaf, newLeaf *html.Node) []FormatChange {
+	oldChain, newChain := elementChain(oldLeaf), elementChain(newLeaf)
+	matched := matchChains(oldChain, newChain)
+	var ret []FormatChange
+	o := 0
+	for i, n := range newChain {
+		if matched[i] < 0 {
+			ret = append(ret, FormatChange{Element: n.Data, Added: true})
+			continue
+		}
+		for ; o < matched[i]; o++ {
+			ret = append(ret, FormatChange{Element: oldChain[o].Data})
+		}
+		o++
+	}
+	for ; o < len(oldChain); o++ {
+		ret = append(ret, FormatChange{Element: oldChain[o].Data})
+	}
+	return ret
+}
+
+// addFormatChanges adds a data-format attribute to the element wrapping a Replaced change, listing the elements
+// added (prefixed by "+") or removed (prefixed by "-"), and a title describing them.
+func addFormatChanges(n *html.Node, changes []FormatChange) {
+	if len(changes) == 0 {
+		return
+	}
+	codes := make([]string, 0, len(changes))
+	descriptions := make([]string, 0, len(changes))
+	for _, fc := range changes {
+		if fc.Added {
+			codes = append(codes, "+"+fc.Element)
+		} else {
+			codes = append(codes, "-"+fc.Element)
+		}
+		descriptions = append(descriptions, fc.String())
+	}
+	n.Attr = append(n.Attr, html.Attribute{Key: "data-format", Val: strings.Join(codes, " ")})
+	addTitle(n, strings.Join(descriptions, ", "))
+}
+
+// addTitle adds to the title of an element, after any title it already has.
+func addTitle(n *html.Node, title string) {
+	for i, a := range n.Attr {
+		if a.Namespace == "" && a.Key == "title" {
+			n.Attr[i].Val += "; " + title
+			return
+		}
+	}
+	n.Attr = append(n.Attr, html.Attribute{Key: "title", Val: title})
+}
@@ -0,0 +1,57 @@
+package htmldiff
+
+import (
+	"io"
+	"strings"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// parseHTML parses a version of the HTML, as a fragment within an element named c.FragmentContext if that is set.
+// A fragment is placed within a copy of the context element in the body of a new document, so that it can be compared like any other.
+func (c *Config) parseHTML(r io.Reader) (*html.Node, error) {
+	if c.FragmentContext == "" {
+		return html.Parse(r)
+	}
+	context := &html.Node{
+		Type:     html.ElementNode,
+		DataAtom: atom.Lookup([]byte(c.FragmentContext)),
+		Data:     c.FragmentContext,
+	}
+	nodes, err := html.ParseFragment(r, context)
+	if err != nil {
+		return nil, err
+	}
+	tree, err := html.Parse(strings.NewReader("<html><head></head><body></body></html>"))
+	if err != nil {
+		return nil, err
+	}
+	parent := findBody(tree)
+	if context.DataAtom != atom.Body {
+		parent.AppendChild(context)
+		parent = context
+	}
+	for _, n := range nodes {
+		parent.AppendChild(n)
+	}
+	return tree, nil
+}
+
+// renderBody writes the contents of the body of an HTML node tree to w, or for c.FragmentContext the contents of the context elements in the body.
+func (c *Config) renderBody(w io.Writer, body *html.Node) error {
+	for n := body.FirstChild; n != nil; n = n.NextSibling {
+		if c.FragmentContext == "" || c.FragmentContext == "body" || n.Type != html.ElementNode || n.Data != c.FragmentContext {
+			if err := html.Render(w, n); err != nil {
+				return err
+			}
+			continue
+		}
+		for ch := n.FirstChild; ch != nil; ch = ch.NextSibling {
+			if err := html.Render(w, ch); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
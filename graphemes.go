@@ -0,0 +1,141 @@
+package htmldiff
+
+import (
+	"unicode"
+	"unicode/utf8"
+)
+
+// graphemeTokens splits text into grapheme clusters, except that runs of clusters in the same Chinese, Japanese
+// (or similar) script, which are written without spaces between words, are kept together as a single token.
+func graphemeTokens(text string) []string {
+	var tokens []string
+	start := 0 // of the current token
+	var lastScript *unicode.RangeTable
+	for i := 0; i < len(text); {
+		r, _ := utf8.DecodeRuneInString(text[i:])
+		script := unspacedScript(r, lastScript)
+		if i > start && (script == nil || script != lastScript) {
+			tokens = append(tokens, text[start:i])
+			start = i
+		}
+		lastScript = script
+		i += clusterSize(text[i:])
+	}
+	if start < len(text) {
+		tokens = append(tokens, text[start:])
+	}
+	return tokens
+}
+
+// unspacedScripts are written without spaces between the words.
+var unspacedScripts = []*unicode.RangeTable{unicode.Han, unicode.Hiragana, unicode.Katakana,
+	unicode.Thai, unicode.Lao, unicode.Khmer, unicode.Myanmar}
+
+// unspacedScript returns the script of the rune, if it is one written without spaces, or nil.
+// Prolonged sound marks continue the previous script.
+func unspacedScript(r rune, previous *unicode.RangeTable) *unicode.RangeTable {
+	if r == 'ー' || r == '〻' {
+		return previous
+	}
+	for _, script := range unspacedScripts {
+		if unicode.Is(script, r) {
+			return script
+		}
+	}
+	return nil
+}
+
+// clusterSize returns the length in bytes of the grapheme cluster at the start of the text.
+// It is a simplified version of the extended grapheme cluster rules of Unicode Standard Annex #29,
+// which does not split letters from combining marks, emoji sequences, flags or Hangul syllables.
+func clusterSize(text string) int {
+	r, size := utf8.DecodeRuneInString(text)
+	if r == '\r' && len(text) > 1 && text[1] == '\n' {
+		return 2
+	}
+	if isControl(r) {
+		return size
+	}
+	regionalIndicators := 0
+	if isRegionalIndicator(r) {
+		regionalIndicators++
+	}
+	prev := r
+	for size < len(text) {
+		next, nextSize := utf8.DecodeRuneInString(text[size:])
+		switch {
+		case isExtend(next): // marks, joiners, variation selectors and emoji modifiers
+		case prev == '\u200d' && unicode.Is(unicode.So, next): // emoji zero width joiner sequence
+		case regionalIndicators == 1 && isRegionalIndicator(next): // a pair of regional indicators is a flag
+			regionalIndicators++
+		case hangulJoins(prev, next):
+		default:
+			return size
+		}
+		prev = next
+		size += nextSize
+	}
+	return size
+}
+
+// isControl returns true for the control characters and separators that are always clusters on their own.
+func isControl(r rune) bool {
+	return r != '\u200c' && r != '\u200d' && (unicode.In(r, unicode.Cc, unicode.Zl, unicode.Zp) ||
+		(unicode.Is(unicode.Cf, r) && !isExtend(r)))
+}
+
+// isExtend returns true for the runes which extend the cluster before them.
+func isExtend(r rune) bool {
+	return unicode.In(r, unicode.Mn, unicode.Me, unicode.Mc) ||
+		r == '\u200c' || r == '\u200d' || // zero width non-joiner and joiner
+		(r >= 0xFE00 && r <= 0xFE0F) || (r >= 0xE0100 && r <= 0xE01EF) || // variation selectors
+		(r >= 0x1F3FB && r <= 0x1F3FF) || // emoji skin tone modifiers
+		(r >= 0xE0020 && r <= 0xE007F) // tags, used in some flags
+}
+
+// isRegionalIndicator returns true for the letters used in pairs to make flags.
+func isRegionalIndicator(r rune) bool {
+	return r >= 0x1F1E6 && r <= 0x1F1FF
+}
+
+// The kinds of Hangul jamo and syllables.
+const (
+	hangulNone = iota
+	hangulL    // leading consonant
+	hangulV    // vowel
+	hangulT    // trailing consonant
+	hangulLV   // syllable without a trailing consonant
+	hangulLVT  // syllable with a trailing consonant
+)
+
+// hangulKind classifies a rune for the Hangul syllable rules.
+func hangulKind(r rune) int {
+	switch {
+	case (r >= 0x1100 && r <= 0x115F) || (r >= 0xA960 && r <= 0xA97C):
+		return hangulL
+	case (r >= 0x1160 && r <= 0x11A7) || (r >= 0xD7B0 && r <= 0xD7C6):
+		return hangulV
+	case (r >= 0x11A8 && r <= 0x11FF) || (r >= 0xD7CB && r <= 0xD7FB):
+		return hangulT
+	case r >= 0xAC00 && r <= 0xD7A3:
+		if (r-0xAC00)%28 == 0 {
+			return hangulLV
+		}
+		return hangulLVT
+	}
+	return hangulNone
+}
+
+// hangulJoins returns true if the Hangul jamo or syllables are part of the same syllable.
+func hangulJoins(prev, next rune) bool {
+	p, n := hangulKind(prev), hangulKind(next)
+	switch p {
+	case hangulL:
+		return n == hangulL || n == hangulV || n == hangulLV || n == hangulLVT
+	case hangulLV, hangulV:
+		return n == hangulV || n == hangulT
+	case hangulLVT, hangulT:
+		return n == hangulT
+	}
+	return false
+}
@@ -1,19 +1,23 @@
 package htmldiff
 
 import (
-	"bytes"
+	"context"
 	"errors"
+	"sort"
 	"strings"
 	"time"
 
 	"github.com/mb0/diff"
 
 	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
 )
 
 // Attribute exists so that this package does not export html.Attribute, to allow vendoring of "golang.org/x/net/html".
 type Attribute struct {
-	Namespace, Key, Val string
+	Namespace string `json:"ns,omitempty"`
+	Key       string `json:"key"`
+	Val       string `json:"val"`
 }
 
 // return the "golang.org/x/net/html" version of a slice of Attribute
@@ -31,127 +35,394 @@ func convertAttributes(atts []Attribute) []html.Attribute {
 
 // Config describes the way that HTMLdiff works.
 type Config struct {
-	Granularity                             int         // how many letters to put together for a change, if possible
+	Granularity                             int         // how many letters (or tokens) to put together for a change, if possible
 	InsertedSpan, DeletedSpan, ReplacedSpan []Attribute // the attributes for the span tags wrapping changes
 	CleanTags                               []string    // HTML tags to clean from the input
+
+	Markup   Markup    // the elements used to mark changes, by default <span>
+	Cite     string    // for InsDelMarkup, the URL of a document explaining the changes, if any
+	DateTime time.Time // for InsDelMarkup and TrackChangesMarkup, the time of the changes, if any
+	Author   string    // for TrackChangesMarkup, the name of the author of the changes, if any
+	AuthorID string    // for TrackChangesMarkup, the user id of the author of the changes, if any
+
+	// Limits on the work done comparing two versions, zero gives the default, negative gives no limit.
+	MaxRunes        int           // the size limit for each version, in letters and other leaf nodes, default DefaultMaxRunes
+	MaxDiffDuration time.Duration // how long the difference calculation may take, default DefaultMaxDiffDuration
+	MaxEditDistance int           // the maximum number of letters inserted and deleted, no limit by default
+	Fallback        Fallback      // the coarsest way to compare versions, if the limits above are exceeded
+
+	Tokenization Tokenization // the units in which text is compared, by default runes
+	Tokenizer    Tokenizer    // if not nil, splits text into the units to compare, instead of Tokenization
+
+	// Hierarchical compares whole block-level elements first, then letter by letter only within the blocks that differ.
+	// This is much faster for large documents, with MaxRunes applying to each range of differing blocks.
+	Hierarchical bool
+
+	ConflictOursSpan, ConflictTheirsSpan []Attribute // for Merge, the attributes for the span tags wrapping each side of a conflict
+
+	// Chain compares each version with the one before it, rather than with versions[0], for a history of revisions.
+	Chain bool
+
+	// DetectMoves, if more than zero, is the number of letters which must be deleted in one place, and the same (or nearly
+	// the same) inserted in another, for them to be marked as moved, wrapped in span tags with the MovedSpan attributes
+	// (or, for InsDelMarkup and TrackChangesMarkup, in <del> and <ins> elements).
+	DetectMoves int
+	MovedSpan   []Attribute
+
+	// ShowAttrChanges adds a title describing any changes to the attributes of the elements containing the text (such as an href or src)
+	// to the element wrapping a replaced change, along with data-old-* attributes giving the old values.
+	ShowAttrChanges bool
+
+	// ShowFormatChanges adds a data-format attribute to the element wrapping a replaced change, listing the elements added
+	// (for example "+b") or removed (for example "-i") around the text, along with a title describing them (for example "bold added").
+	ShowFormatChanges bool
+
+	// MaxConcurrency is the most goroutines used at once to parse or compare the versions, zero for no limit.
+	// One gives fully sequential execution, using only the calling goroutine.
+	MaxConcurrency int
+
+	// FragmentContext, if set, is the name of the element (for example "tbody", "ul" or "div") within which each version is
+	// parsed as a fragment, rather than as a whole document, so that fragments such as table rows or list items are not re-arranged.
+	// The merged HTML is then the merged contents of that element.
+	FragmentContext string
+
+	bodiesOnly bool // set by HTMLdiffDocuments, to compare only the bodies of whole documents
 }
 
+// Fallback describes a coarser, but cheaper, way of comparing versions when the limits are exceeded.
+type Fallback int
+
+// The fallbacks available, from the most to the least precise.
+// When a fallback is used, the others before it in this list have already been tried.
+// FallbackBlocks is also given when finding moves (see DetectMoves) runs out of time, with the changes kept but no moves marked.
+const (
+	NoFallback       Fallback = iota // compare letter by letter, return an error if the limits are exceeded
+	FallbackBlocks                   // compare whole block-level elements, such as paragraphs, list items and table rows
+	FallbackDocument                 // replace the whole document
+)
+
+// Result holds the merged HTML for an edit, along with how it was made.
+type Result struct {
+	HTML     string
+	Fallback Fallback // if not NoFallback, then the result is less precise than usual
+	Err      error    // if not nil, a *StageError saying why there is no merged HTML for this edit
+}
+
+// The default limits used when the Config fields are zero, from initial testing.
+const (
+	DefaultMaxRunes        = 250000
+	DefaultMaxDiffDuration = time.Second * 3
+)
+
+// Errors returned when the limits in Config are exceeded.
+var (
+	ErrInputTooLarge  = errors.New("input data too large")
+	ErrDiffTimeout    = errors.New("diff.Diff() took too long")
+	ErrTooManyChanges = errors.New("edit distance too large")
+)
+
+// maxRunes returns the size limit to use, or -1 for no limit.
+func (c *Config) maxRunes() int {
+	switch {
+	case c.MaxRunes == 0:
+		return DefaultMaxRunes
+	case c.MaxRunes < 0:
+		return -1
+	}
+	return c.MaxRunes
+}
+
+// maxDiffDuration returns the time limit to use, or -1 for no limit.
+func (c *Config) maxDiffDuration() time.Duration {
+	switch {
+	case c.MaxDiffDuration == 0:
+		return DefaultMaxDiffDuration
+	case c.MaxDiffDuration < 0:
+		return -1
+	}
+	return c.MaxDiffDuration
+}
+
+var (
+	errTooFewVersions = errors.New("there must be at least two versions to diff, the 0th element is the base")
+	errWriterCount    = errors.New("there must be one io.Writer for each edit")
+	errReaderUsed     = errors.New("a ReaderVersion can only be read once")
+)
+
 // HTMLdiff finds all the differences in the versions of HTML snippits,
 // versions[0] is the original, all other versions are the edits to be compared.
 // The resulting merged HTML snippits are as many as there are edits to compare.
+// If c.Chain is set, each edit is compared with the version before it, rather than the original.
 func (c *Config) HTMLdiff(versions []string) ([]string, error) {
+	return c.HTMLdiffContext(context.Background(), versions)
+}
+
+// HTMLdiffContext is the same as HTMLdiff, except that the parsing, differencing and merging
+// of the versions stops as soon as ctx is cancelled or passes its deadline, returning ctx.Err().
+func (c *Config) HTMLdiffContext(ctx context.Context, versions []string) ([]string, error) {
 	if len(versions) < 2 {
-		return nil, errors.New("there must be at least two versions to diff, the 0th element is the base")
-	}
-	parallelErrors := make(chan error, len(versions))
-	sourceTrees := make([]*html.Node, len(versions))
-	sourceTreeRunes := make([]*[]treeRune, len(versions))
-	firstLeaves := make([]int, len(versions))
-	for v, vv := range versions {
-		go func(v int, vv string) {
-			var err error
-			sourceTrees[v], err = html.Parse(strings.NewReader(vv))
-			if err == nil {
-				tr := make([]treeRune, 0, c.clean(sourceTrees[v]))
-				sourceTreeRunes[v] = &tr
-				renderTreeRunes(sourceTrees[v], &tr)
-				leaf1, ok := firstLeaf(findBody(sourceTrees[v]))
-				if leaf1 == nil || !ok {
-					firstLeaves[v] = 0 // could be wrong, but correct for simple examples
-				} else {
-					for x, y := range tr {
-						if y.leaf == leaf1 {
-							firstLeaves[v] = x
-							break
-						}
-					}
-				}
+		return nil, errTooFewVersions
+	}
+	mergedHTMLs := make([]string, len(versions)-1)
+	err := c.compareVersions(ctx, stringVersions(versions), func(m int, ap *appendContext) (err error) {
+		mergedHTMLs[m], err = ap.render(ctx)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return mergedHTMLs, nil
+}
+
+// source holds a version of the HTML, parsed and prepared for comparison.
+type source struct {
+	tree      *html.Node
+	treeRunes *[]treeRune
+	firstLeaf int       // index in treeRunes of the first leaf in the body, or the number of treeRunes if the body is empty
+	bodyEnd   int       // index in treeRunes after the last leaf in the body, see body()
+	bodyOnly  bool      // from the Version, see BytesVersion
+	segs      []segment // the segments of the treeRunes, if prepared in advance, see segments()
+	bodySrc   *source   // the body of the source, if prepared in advance, see body()
+}
+
+// parse prepares one version of the HTML, held in a string, for comparison.
+func (c *Config) parse(ctx context.Context, vv string) (*source, error) {
+	return c.parseVersion(ctx, StringVersion(vv))
+}
+
+// parseVersion prepares one version of the HTML for comparison.
+func (c *Config) parseVersion(ctx context.Context, v Version) (*source, error) {
+	var tree *html.Node
+	var err error
+	switch {
+	case v.tree != nil:
+		tree, err = c.htmlTree(v.tree)
+	case v.r != nil:
+		r := v.r.take()
+		if r == nil {
+			return nil, errReaderUsed
+		}
+		tree, err = c.parseHTML(ctxReader{ctx, r})
+	case v.b != nil:
+		tree, err = c.parseHTML(ctxReader{ctx, decodeBytes(v.b)})
+	default:
+		tree, err = c.parseHTML(ctxReader{ctx, strings.NewReader(v.s)})
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err = ctx.Err(); err != nil { // parseHTML() may have finished reading before the cancellation
+		return nil, err
+	}
+	tr := make([]treeRune, 0, c.clean(tree))
+	renderTreeRunes(tree, &tr, c.tokenizer())
+	src := &source{tree: tree, treeRunes: &tr, bodyOnly: v.bodyOnly}
+	src.firstLeaf, src.bodyEnd = len(tr), len(tr)
+	for x := range tr {
+		if inBody(tr[x].leaf) {
+			if src.firstLeaf == len(tr) {
+				src.firstLeaf = x
 			}
-			parallelErrors <- err
-		}(v, vv)
+			src.bodyEnd = x + 1
+		}
+	}
+	return src, nil
+}
+
+// body returns the source with only the treeRunes inside the body, which may be none.
+func (s *source) body() *source {
+	if s.bodySrc != nil {
+		return s.bodySrc
+	}
+	tr := (*s.treeRunes)[s.firstLeaf:s.bodyEnd]
+	return &source{tree: s.tree, treeRunes: &tr, bodyEnd: len(tr)}
+}
+
+// outsideBody returns true if the source has leaves outside the body, such as the text of a <title>,
+// other than the empty <head> which parsing gives every snippit.
+func (s *source) outsideBody() bool {
+	for x, r := range *s.treeRunes {
+		if (x < s.firstLeaf || x >= s.bodyEnd) && (r.leaf.Type != html.ElementNode || r.leaf.DataAtom != atom.Head) {
+			return true
+		}
+	}
+	return false
+}
+
+// compareVersions parses all of the versions (of which there must be at least two) in parallel, then compares each edit with the base
+// (or with the previous version, for c.Chain) in parallel, within c.MaxConcurrency, passing the results to found, which is called concurrently with m being the index of the edit less one.
+// Each version is only parsed once, even when it is compared twice.
+func (c *Config) compareVersions(ctx context.Context, versions []Version, found func(m int, ap *appendContext) error) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel() // on error return, stop any work still in progress
+	sources, err := c.parseVersions(ctx, versions)
+	if err != nil {
+		return err
 	}
-	for range versions {
-		if err := <-parallelErrors; err != nil {
-			return nil, err
+
+	// now all the input trees are buit, we can do the comparisons
+	return c.parallel(ctx, len(versions)-1, func(ctx context.Context, m int) error {
+		base := sources[0]
+		if c.Chain {
+			base = sources[m]
+		}
+		ap, err := c.compare(ctx, base, sources[m+1])
+		if err != nil {
+			return err
 		}
+		return found(m, ap)
+	})
+}
+
+// compare finds the differences between two prepared versions of the HTML, using a Fallback if allowed.
+// Only the bodies are compared where needed, see bodies().
+func (c *Config) compare(ctx context.Context, a, b *source) (*appendContext, error) {
+	cs := c.bodies([]*source{a, b})
+	ca, cb := cs[0], cs[1]
+	diffCtx, cancel := c.withMaxDiffDuration(ctx)
+	defer cancel()
+	changes, fallback, err := c.diffWithin(ctx, diffCtx, ca, cb)
+	if err != nil {
+		return nil, err
+	}
+	ap, err := c.walkChanges(ctx, diffCtx, changes, ca.treeRunes, cb.treeRunes, ca.firstLeaf, cb.firstLeaf)
+	if err != nil {
+		return nil, err
 	}
+	if fallback > ap.fallback {
+		ap.fallback = fallback
+	}
+	ap.base, ap.edit = a, b
+	return ap, nil
+}
 
-	// now all the input trees are buit, we can do the merge
-	mergedHTMLs := make([]string, len(versions)-1)
+// withMaxDiffDuration returns ctx limited to c.MaxDiffDuration, if there is a limit, for all of the work of comparing two versions.
+func (c *Config) withMaxDiffDuration(ctx context.Context) (context.Context, context.CancelFunc) {
+	if max := c.maxDiffDuration(); max >= 0 {
+		return context.WithTimeout(ctx, max)
+	}
+	return context.WithCancel(ctx)
+}
 
-	for m := range mergedHTMLs {
-		go func(m int) {
-			treeRuneLimit := 250000 // from initial testing
-			if len(*sourceTreeRunes[0]) > treeRuneLimit || len(*sourceTreeRunes[m+1]) > treeRuneLimit {
-				parallelErrors <- errors.New("input data too large")
-				return
-			}
-			dd := diffData{a: sourceTreeRunes[0], b: sourceTreeRunes[m+1]}
-			var changes []diff.Change
-			ch := make(chan []diff.Change)
-			go func(ch chan []diff.Change) {
-				ch <- diff.Diff(len(*sourceTreeRunes[0]), len(*sourceTreeRunes[m+1]), dd)
-			}(ch)
-			to := time.After(time.Second * 3)
-			select {
-			case <-to:
-				parallelErrors <- errors.New("diff.Diff() took too long")
-				go func(ch chan []diff.Change) {
-					<-ch // make sure the timed-out diff cleans-up
-				}(ch)
-				return
-			case changes = <-ch:
-				// we have the diff
-				go func(to <-chan time.Time) {
-					<-to // make sure we don't leak the timer goroutine
-				}(to)
-			}
-			changes = granular(c.Granularity, dd, changes)
-			mergedTree, err := c.walkChanges(changes, sourceTreeRunes[0], sourceTreeRunes[m+1], firstLeaves[0], firstLeaves[m+1])
-			if err != nil {
-				parallelErrors <- err
-				return
-			}
-			var mergedHTMLbuff bytes.Buffer
-			err = html.Render(&mergedHTMLbuff, mergedTree)
-			if err != nil {
-				parallelErrors <- err
-				return
-			}
-			mergedHTML := mergedHTMLbuff.Bytes()
-			pfx := []byte("<html><head></head><body>")
-			sfx := []byte("</body></html>")
-			if bytes.HasPrefix(mergedHTML, pfx) && bytes.HasSuffix(mergedHTML, sfx) {
-				mergedHTML = bytes.TrimSuffix(bytes.TrimPrefix(mergedHTML, pfx), sfx)
-				mergedHTMLs[m] = string(mergedHTML)
-				parallelErrors <- nil
-				return
-			}
-			parallelErrors <- errors.New("correct render wrapper HTML not found: " + string(mergedHTML))
-		}(m)
+// bodies returns the sources to compare with each other. Where any of them has leaves outside the body, as whole documents do,
+// only the bodies are compared, so that differences in the heads (such as the title) do not misalign the changes.
+func (c *Config) bodies(sources []*source) []*source {
+	whole := !c.bodiesOnly
+	for _, s := range sources {
+		if s.bodyOnly || s.outsideBody() {
+			whole = false
+		}
 	}
-	for range mergedHTMLs {
-		if err := <-parallelErrors; err != nil {
-			return nil, err
+	if whole {
+		return sources
+	}
+	ret := make([]*source, len(sources))
+	for i, s := range sources {
+		ret[i] = s.body()
+	}
+	return ret
+}
+
+// diffSources finds the granular changes between two prepared versions of the HTML, using a Fallback if allowed, within c.MaxDiffDuration.
+func (c *Config) diffSources(ctx context.Context, a, b *source) ([]diff.Change, Fallback, error) {
+	diffCtx, cancel := c.withMaxDiffDuration(ctx)
+	defer cancel()
+	return c.diffWithin(ctx, diffCtx, a, b)
+}
+
+// diffWithin is diffSources(), where diffCtx is ctx limited to c.MaxDiffDuration by withMaxDiffDuration(), so that the caller
+// may use what is left of the MaxDiffDuration afterwards. Comparing letter by letter, then by blocks, shares the MaxDiffDuration,
+// with half of it kept back for the blocks.
+func (c *Config) diffWithin(ctx, diffCtx context.Context, a, b *source) ([]diff.Change, Fallback, error) {
+	lenA, lenB := len(*a.treeRunes), len(*b.treeRunes)
+	letterCtx := diffCtx
+	if max := c.maxDiffDuration(); max >= 0 && c.Fallback >= FallbackBlocks {
+		var cancelLetters context.CancelFunc
+		letterCtx, cancelLetters = context.WithTimeout(diffCtx, max/2)
+		defer cancelLetters()
+	}
+	timedOut := func(err error) error {
+		if err == context.DeadlineExceeded && ctx.Err() == nil {
+			return ErrDiffTimeout
 		}
+		return err
 	}
-	return mergedHTMLs, nil
+	fallback := NoFallback
+	changes, err := c.diffTreeRunes(letterCtx, a, b)
+	err = timedOut(err)
+	if isLimitError(err) && c.Fallback >= FallbackBlocks {
+		fallback = FallbackBlocks
+		changes, err = c.diffBlocks(diffCtx, a, b)
+		err = timedOut(err)
+		if isLimitError(err) && c.Fallback >= FallbackDocument {
+			fallback = FallbackDocument
+			changes, err = []diff.Change{{A: 0, B: 0, Del: lenA, Ins: lenB}}, nil
+		}
+	}
+	if err != nil {
+		return nil, NoFallback, err
+	}
+	return granular(c.Granularity, diffData{a: a.treeRunes, b: b.treeRunes}, changes), fallback, nil
 }
 
-// walkChanges goes through the changes identified by diff, identifies where a change is a repacement,
-// then appends the changes to the output set. Once that set is complete, after ctx.flush(),
-// they are finally resorted (to re-order those in containers) and written out using ctx.sortAndWrite().
-func (c *Config) walkChanges(changes []diff.Change, ap, bp *[]treeRune, aIdx, bIdx int) (*html.Node, error) {
-	mergedTree, err := html.Parse(strings.NewReader("<html><head></head><body></body></html>"))
+// isLimitError returns true if the error is caused by exceeding one of the limits in Config.
+func isLimitError(err error) bool {
+	return err == ErrInputTooLarge || err == ErrDiffTimeout || err == ErrTooManyChanges
+}
+
+// diffTreeRunes finds the differences between two prepared versions of the HTML, letter by letter, within the limits,
+// except for MaxDiffDuration, which is the deadline of ctx, see diffSources().
+func (c *Config) diffTreeRunes(ctx context.Context, a, b *source) ([]diff.Change, error) {
+	lenA, lenB := len(*a.treeRunes), len(*b.treeRunes)
+	if c.MaxEditDistance > 0 && (lenA-lenB > c.MaxEditDistance || lenB-lenA > c.MaxEditDistance) {
+		return nil, ErrTooManyChanges // the difference in length is the least number of changes possible
+	}
+	var changes []diff.Change
+	var err error
+	if c.Hierarchical {
+		changes, err = c.diffHierarchical(ctx, a, b)
+	} else {
+		changes, err = c.diffRange(ctx, *a.treeRunes, *b.treeRunes)
+	}
 	if err != nil {
 		return nil, err
 	}
+	if c.MaxEditDistance > 0 {
+		distance := 0
+		for _, change := range changes {
+			distance += change.Del + change.Ins
+		}
+		if distance > c.MaxEditDistance {
+			return nil, ErrTooManyChanges
+		}
+	}
+	return changes, nil
+}
+
+// diffRange finds the differences between two ranges of treeRunes, letter by letter, within the size limit.
+func (c *Config) diffRange(ctx context.Context, a, b []treeRune) ([]diff.Change, error) {
+	if max := c.maxRunes(); max >= 0 && (len(a) > max || len(b) > max) {
+		return nil, ErrInputTooLarge
+	}
+	dd := diffData{a: &a, b: &b, cancel: &canceller{ctx: ctx}}
+	return diffContext(ctx, len(a), len(b), dd)
+}
+
+// walkChanges goes through the changes identified by diff, identifies where a change is a repacement,
+// then appends the changes to the output set. Once that set is complete, after app.flush(),
+// they are finally resorted (to re-order those in containers) using sort.Stable(app) and numbered, ready to be written out.
+// Any moves are found within what is left of the MaxDiffDuration of diffCtx, see diffWithin(),
+// or if that runs out and c.Fallback allows, the changes are kept without moves, see FallbackBlocks.
+func (c *Config) walkChanges(ctx, diffCtx context.Context, changes []diff.Change, ap, bp *[]treeRune, aIdx, bIdx int) (*appendContext, error) {
 	a := *ap
 	b := *bp
-	ctx := &appendContext{c: c, target: mergedTree}
-	for _, change := range changes {
+	app := &appendContext{c: c}
+	for ci, change := range changes {
+		if ci%cancelCheckInterval == 0 && ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
 		for aIdx < change.A && bIdx < change.B {
-			ctx.append('=', a, aIdx)
+			app.append('=', a, aIdx, otherRune(b, bIdx))
 			aIdx++
 			bIdx++
 		}
@@ -160,12 +431,12 @@ func (c *Config) walkChanges(changes []diff.Change, ap, bp *[]treeRune, aIdx, bI
 				if aIdx+i >= len(a) || bIdx+i >= len(b) {
 					goto textDifferent // defensive after fuzz testing
 				}
-				if a[aIdx+i].letter != b[bIdx+i].letter {
+				if !a[aIdx+i].sameText(b[bIdx+i]) {
 					goto textDifferent
 				}
 			}
 			for i := 0; i < change.Del; i++ {
-				ctx.append('~', b, bIdx)
+				app.append('~', b, bIdx, otherRune(a, aIdx))
 				aIdx++
 				bIdx++
 			}
@@ -173,21 +444,30 @@ func (c *Config) walkChanges(changes []diff.Change, ap, bp *[]treeRune, aIdx, bI
 		}
 	textDifferent:
 		for i := 0; i < change.Del; i++ {
-			ctx.append('-', a, aIdx)
+			app.append('-', a, aIdx, nil)
 			aIdx++
 		}
 		for i := 0; i < change.Ins; i++ {
-			ctx.append('+', b, bIdx)
+			app.append('+', b, bIdx, nil)
 			bIdx++
 		}
 	textSame:
 	}
 	for aIdx < len(a) && bIdx < len(b) {
-		ctx.append('=', a, aIdx)
+		app.append('=', a, aIdx, otherRune(b, bIdx))
 		aIdx++
 		bIdx++
 	}
-	ctx.flush()
-	ctx.sortAndWrite()
-	return mergedTree, nil
+	app.flush()
+	sort.Stable(app)
+	if c.DetectMoves > 0 {
+		if err := c.detectMoves(ctx, diffCtx, app); err != nil {
+			if err != ErrDiffTimeout || c.Fallback < FallbackBlocks {
+				return nil, err
+			}
+			app.fallback = FallbackBlocks // the changes found are kept, without moves
+		}
+	}
+	app.numberChanges()
+	return app, nil
 }
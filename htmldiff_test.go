@@ -1,15 +1,23 @@
 package htmldiff_test
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
 	"fmt"
+	htm "html"
+	"io"
 	"io/ioutil"
 	"os"
 	"runtime"
 	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/documize/html-diff"
+
+	"golang.org/x/net/html"
 )
 
 var cfg = &htmldiff.Config{
@@ -277,6 +285,9 @@ var simpleTests = []simpleTest{
 
 func TestSimple(t *testing.T) {
 
+	if err := os.MkdirAll("testout", 0777); err != nil {
+		t.Fatal(err)
+	}
 	for s, st := range simpleTests {
 		res, err := cfg.HTMLdiff(st.versions)
 		if err != nil {
@@ -302,6 +313,1109 @@ func TestSimple(t *testing.T) {
 
 }
 
+func TestChanges(t *testing.T) {
+	res, err := cfg.Changes([]string{"<ul><li>1</li><li>2</li></ul><p>Hello <b>world</b></p>",
+		"<ul><li>1</li><li>two</li></ul><p>Hello world</p>"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []htmldiff.Change{
+		{Action: htmldiff.Unchanged, Old: "1", New: "1", Path: []string{"ul", "li"}, Pos: []int{0, 0, 0}},
+		{Action: htmldiff.Deleted, ID: 1, Old: "2", Path: []string{"ul", "li"}, Pos: []int{0, 1, 0}},
+		{Action: htmldiff.Inserted, ID: 2, New: "two", Path: []string{"ul", "li"}, Pos: []int{0, 1, 0}},
+		{Action: htmldiff.Unchanged, Old: "Hello ", New: "Hello ", Path: []string{"p"}, Pos: []int{}},
+		{Action: htmldiff.Replaced, ID: 3, Old: "world", New: "world", Path: []string{"p"}, Pos: []int{}},
+	}
+	if len(res) != 1 || len(res[0]) != len(want) {
+		t.Fatalf("wanted: %v got: %v", want, res)
+	}
+	for i, ch := range res[0] {
+		w := want[i]
+		if ch.Action != w.Action || ch.ID != w.ID || ch.Old != w.Old || ch.New != w.New ||
+			fmt.Sprint(ch.Path, ch.Pos) != fmt.Sprint(w.Path, w.Pos) {
+			t.Errorf("change %d wanted: %+v got: %+v", i, w, ch)
+		}
+	}
+	if _, err := cfg.Changes([]string{"abc"}); err == nil {
+		t.Error("a single version should give an error")
+	}
+}
+
+func TestLimits(t *testing.T) {
+	bbc := bbcNews1 + bbcNews2
+	args := []string{bbc, strings.ToUpper(bbc)}
+	for _, lt := range []struct {
+		cfg htmldiff.Config
+		err error
+	}{
+		{htmldiff.Config{MaxRunes: 1000}, htmldiff.ErrInputTooLarge},
+		{htmldiff.Config{MaxRunes: -1, MaxDiffDuration: time.Millisecond}, htmldiff.ErrDiffTimeout},
+	} {
+		if _, err := lt.cfg.HTMLdiff(args); err != lt.err {
+			t.Errorf("config %+v wanted error %v got %v", lt.cfg, lt.err, err)
+		}
+	}
+	words := "<p>" + strings.Repeat("abc ", 100) + "</p>"
+	if _, err := (&htmldiff.Config{MaxEditDistance: 10}).HTMLdiff([]string{words, strings.ToUpper(words)}); err != htmldiff.ErrTooManyChanges {
+		t.Errorf("large edit distance wanted error %v got %v", htmldiff.ErrTooManyChanges, err)
+	}
+	if _, err := (&htmldiff.Config{MaxEditDistance: 10}).HTMLdiff([]string{"abc", "ABC"}); err != nil {
+		t.Errorf("small edit distance error %v", err)
+	}
+	if _, err := (&htmldiff.Config{MaxEditDistance: 10}).HTMLdiff([]string{"abc", "abcdefghijklmnopqrstuvwxyz"}); err != htmldiff.ErrTooManyChanges {
+		t.Errorf("different lengths wanted error %v got %v", htmldiff.ErrTooManyChanges, err)
+	}
+}
+
+func TestFallback(t *testing.T) {
+	args := []string{bbcNews1 + bbcNews2, bbcNews1 + "<div><i>HTML-Diff-Inserted</i></div>" + bbcNews2}
+	blocksCfg := *cfg
+	blocksCfg.MaxRunes = 1000
+	blocksCfg.Fallback = htmldiff.FallbackBlocks
+	res, err := blocksCfg.HTMLdiffResults(context.Background(), args)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res[0].Fallback != htmldiff.FallbackBlocks {
+		t.Errorf("wanted fallback %d got %d", htmldiff.FallbackBlocks, res[0].Fallback)
+	}
+	if !strings.Contains(res[0].HTML, simpleTests[7].diffs[0]) || strings.Contains(res[0].HTML, cfg.DeletedSpan[0].Val) {
+		t.Errorf("block fallback did not find only the inserted div")
+	}
+
+	docCfg := *cfg
+	docCfg.MaxDiffDuration = time.Nanosecond
+	docCfg.Fallback = htmldiff.FallbackDocument
+	res, err = docCfg.HTMLdiffResults(context.Background(), []string{"<p>abc</p>", "<p>abd</p>"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `<p><span style="` + cfg.DeletedSpan[0].Val + `">abc</span><span style="` + cfg.InsertedSpan[0].Val + `">abd</span></p>`
+	if res[0].Fallback != htmldiff.FallbackDocument || res[0].HTML != want {
+		t.Errorf("document fallback wanted: %d `%s` got: %d `%s`", htmldiff.FallbackDocument, want, res[0].Fallback, res[0].HTML)
+	}
+
+	// both the letter and the block comparisons of these time out, sharing one MaxDiffDuration, before the document fallback;
+	// the time taken is only checked against a generous bound, so as not to fail on a slow or busy machine
+	var a, b strings.Builder
+	for i := 0; i < 5000; i++ {
+		fmt.Fprintf(&a, "<p>a%d</p>", i)
+		fmt.Fprintf(&b, "<p>b%d</p>", i)
+	}
+	docCfg.MaxDiffDuration = 200 * time.Millisecond
+	start := time.Now()
+	res, err = docCfg.HTMLdiffResults(context.Background(), []string{a.String(), b.String()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res[0].Err != nil || res[0].Fallback != htmldiff.FallbackDocument {
+		t.Errorf("document fallback after timeouts wanted fallback %d got %d with error %v", htmldiff.FallbackDocument, res[0].Fallback, res[0].Err)
+	}
+	if d := time.Since(start); d > 20*docCfg.MaxDiffDuration {
+		t.Errorf("document fallback after timeouts took %v, with a MaxDiffDuration of %v", d, docCfg.MaxDiffDuration)
+	}
+}
+
+func TestResults(t *testing.T) {
+	bbc := bbcNews1 + bbcNews2
+	limitCfg := *cfg
+	limitCfg.MaxRunes = 1000
+	res, err := limitCfg.HTMLdiffResults(context.Background(), []string{"<p>abc</p>", bbc, "<p>abd</p>"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	se, ok := res[0].Err.(*htmldiff.StageError)
+	if !ok || se.Stage != htmldiff.StageLimit || se.Unwrap() != htmldiff.ErrInputTooLarge || res[0].HTML != "" {
+		t.Errorf("wanted a limit error for the large edit, got %v", res[0].Err)
+	}
+	want := `<p>ab<span style="` + cfg.DeletedSpan[0].Val + `">c</span><span style="` + cfg.InsertedSpan[0].Val + `">d</span></p>`
+	if res[1].Err != nil || res[1].HTML != want {
+		t.Errorf("small edit wanted: `%s` got: `%s` %v", want, res[1].HTML, res[1].Err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	res, err = cfg.HTMLdiffResults(ctx, []string{"<p>abc</p>", "<p>abd</p>"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if se, ok := res[0].Err.(*htmldiff.StageError); !ok || se.Stage != htmldiff.StageCancel || se.Unwrap() != context.Canceled {
+		t.Errorf("wanted a cancel error for a context cancelled before parsing, got %v", res[0].Err)
+	}
+
+	timeCfg := *cfg
+	timeCfg.MaxDiffDuration = time.Nanosecond
+	res, err = timeCfg.HTMLdiffResults(context.Background(), []string{bbc, strings.ToUpper(bbc)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if se, ok := res[0].Err.(*htmldiff.StageError); !ok || se.Stage != htmldiff.StageTimeout || se.Unwrap() != htmldiff.ErrDiffTimeout ||
+		res[0].HTML != "" || res[0].Fallback != htmldiff.NoFallback {
+		t.Errorf("wanted a timeout error, got %v", res[0].Err)
+	}
+
+	// cancel while tokenizing the last version, after parsing it, so that the comparison is cancelled
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	cancelCfg := *cfg
+	cancelCfg.MaxConcurrency = 1
+	cancelCfg.Tokenizer = htmldiff.TokenizerFunc(func(text string) []string {
+		if strings.Contains(text, "zyzzyva") {
+			cancel()
+		}
+		return strings.Fields(text)
+	})
+	res, err = cancelCfg.HTMLdiffResults(ctx, []string{bbc, "<p>zyzzyva</p>"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if se, ok := res[0].Err.(*htmldiff.StageError); !ok || se.Stage != htmldiff.StageCancel || se.Unwrap() != context.Canceled {
+		t.Errorf("wanted a cancel error, got %v", res[0].Err)
+	}
+}
+
+func TestHierarchical(t *testing.T) {
+	hierCfg := *cfg
+	hierCfg.Hierarchical = true
+	for s, st := range simpleTests[:10] { // the later tests give different, but reasonable, results
+		res, err := hierCfg.HTMLdiff(st.versions)
+		if err != nil {
+			t.Errorf("Hierarchical test %d had error %v", s, err)
+		}
+		for d := range st.diffs {
+			if d < len(res) && !strings.Contains(res[d], st.diffs[d]) {
+				t.Errorf("Hierarchical test %d diff %d wanted: `%s` got: `%s`", s, d, st.diffs[d], res[d])
+			}
+		}
+	}
+}
+
+func TestWords(t *testing.T) {
+	wordCfg := *cfg
+	wordCfg.Granularity = 0
+	wordCfg.Tokenization = htmldiff.ByWord
+	ins := `<span style="` + cfg.InsertedSpan[0].Val + `">`
+	del := `<span style="` + cfg.DeletedSpan[0].Val + `">`
+	for _, wt := range []struct{ versions, diffs []string }{
+		{[]string{"hElLo is that documize!", "Hello is that Documize?"},
+			[]string{del + "hElLo</span>" + ins + "Hello</span> is that " + del + "documize!</span>" + ins + "Documize?</span>"}},
+		{[]string{"<p>The  quick, brown fox.</p>", "<p>The quick brown <b>fox</b>!</p>"},
+			[]string{"<p>The" + del + "  </span>" + ins + " </span>quick" + del + ",</span> brown " +
+				del + "fox.</span><b>" + ins + "fox</span></b>" + ins + "!</span></p>"}},
+	} {
+		res, err := wordCfg.HTMLdiff(wt.versions)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for d := range wt.diffs {
+			if res[d] != wt.diffs[d] {
+				t.Errorf("word test wanted: `%s` got: `%s`", wt.diffs[d], res[d])
+			}
+		}
+	}
+}
+
+func TestTokenizers(t *testing.T) {
+	for _, tt := range []struct {
+		tokenizer htmldiff.Tokenizer
+		text      string
+		tokens    []string
+	}{
+		{htmldiff.WordTokenizer, "Don't  stop, café-au-lait 42!", []string{"Don", "'", "t", "  ", "stop", ",", " ", "café", "-", "au", "-", "lait", " ", "42", "!"}},
+		{htmldiff.SentenceTokenizer, "Pi is 3.14. Is it?  \"Yes!\" he said", []string{"Pi is 3.14.", " ", "Is it?", "  ", "\"Yes!\"", " ", "he said"}},
+		{htmldiff.SentenceTokenizer, "中文。句子！ End.", []string{"中文。", "句子！", " ", "End."}},
+		{htmldiff.WordTokenizer, "chinese中文 cafe\u0301 👩\u200d💻!", []string{"chinese", "中文", " ", "cafe\u0301", " ", "👩\u200d💻", "!"}},
+		{htmldiff.GraphemeTokenizer, "ae\u0301🇬🇧👍🏽ひらがなカタカナー漢字한국", []string{"a", "e\u0301", "🇬🇧", "👍🏽", "ひらがな", "カタカナー", "漢字", "한", "국"}},
+		{htmldiff.GraphemeTokenizer, "\u1100\u1161\u11a8\r\n", []string{"\u1100\u1161\u11a8", "\r\n"}},
+	} {
+		if got := tt.tokenizer.Tokenize(tt.text); fmt.Sprintf("%q", got) != fmt.Sprintf("%q", tt.tokens) {
+			t.Errorf("tokenizing `%s` wanted: %q got: %q", tt.text, tt.tokens, got)
+		}
+	}
+
+	grCfg := *cfg
+	grCfg.Granularity = 0
+	grCfg.Tokenization = htmldiff.ByGrapheme
+	res, err := grCfg.HTMLdiff([]string{"chinese中文 cafe\u0301", "chinese中國 cafe"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `chinese<span style="` + cfg.DeletedSpan[0].Val + `">中文</span><span style="` + cfg.InsertedSpan[0].Val + `">中國</span> caf` +
+		`<span style="` + cfg.DeletedSpan[0].Val + `">e` + "\u0301" + `</span><span style="` + cfg.InsertedSpan[0].Val + `">e</span>`
+	if res[0] != want {
+		t.Errorf("grapheme tokenization wanted: `%s` got: `%s`", want, res[0])
+	}
+
+	// a Tokenizer that keeps template placeholders whole
+	placeholders := htmldiff.TokenizerFunc(func(text string) []string {
+		var tokens []string
+		for {
+			start := strings.Index(text, "{{")
+			end := strings.Index(text, "}}")
+			if start < 0 || end < start {
+				return append(tokens, htmldiff.WordTokenizer.Tokenize(text)...)
+			}
+			tokens = append(tokens, htmldiff.WordTokenizer.Tokenize(text[:start])...)
+			tokens = append(tokens, text[start:end+2])
+			text = text[end+2:]
+		}
+	})
+	tokCfg := *cfg
+	tokCfg.Granularity = 0
+	tokCfg.Tokenizer = placeholders
+	res, err = tokCfg.HTMLdiff([]string{"Dear {{first name}},", "Dear {{full name}},"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = `Dear <span style="` + cfg.DeletedSpan[0].Val + `">{{first name}}</span><span style="` + cfg.InsertedSpan[0].Val + `">{{full name}}</span>,`
+	if res[0] != want {
+		t.Errorf("placeholder tokenizer wanted: `%s` got: `%s`", want, res[0])
+	}
+
+	// an invalid Tokenizer falls back to comparing runes
+	tokCfg.Tokenizer = htmldiff.TokenizerFunc(strings.Fields)
+	res, err = tokCfg.HTMLdiff([]string{"ab cd", "ab ce"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = `ab c<span style="` + cfg.DeletedSpan[0].Val + `">d</span><span style="` + cfg.InsertedSpan[0].Val + `">e</span>`
+	if res[0] != want {
+		t.Errorf("invalid tokenizer wanted: `%s` got: `%s`", want, res[0])
+	}
+}
+
+func TestInsDelMarkup(t *testing.T) {
+	insDelCfg := &htmldiff.Config{
+		Tokenization: htmldiff.ByWord,
+		ReplacedSpan: []htmldiff.Attribute{{Key: "class", Val: "format-change"}},
+		Markup:       htmldiff.InsDelMarkup,
+		Cite:         "http://documize.com/changes",
+		DateTime:     time.Date(2016, 5, 3, 12, 30, 0, 0, time.UTC),
+	}
+	res, err := insDelCfg.HTMLdiff([]string{"<p>The quick brown fox</p>", "<p>The <b>quick</b> red fox</p>"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `<p>The <b><span class="format-change">quick</span></b> ` +
+		`<del cite="http://documize.com/changes" datetime="2016-05-03T12:30:00Z">brown</del>` +
+		`<ins cite="http://documize.com/changes" datetime="2016-05-03T12:30:00Z">red</ins> fox</p>`
+	if res[0] != want {
+		t.Errorf("ins/del markup wanted: `%s` got: `%s`", want, res[0])
+	}
+	insDelCfg.ReplacedSpan = nil
+	res, err = insDelCfg.HTMLdiff([]string{"<p>The quick fox</p>", "<p>The <b>quick</b> fox</p>"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = `<p>The <b><span class="format-change">quick</span></b> fox</p>`
+	if res[0] != want {
+		t.Errorf("ins/del markup without a ReplacedSpan wanted: `%s` got: `%s`", want, res[0])
+	}
+}
+
+func TestTrackChangesMarkup(t *testing.T) {
+	tcCfg := &htmldiff.Config{
+		Tokenization: htmldiff.ByWord,
+		Markup:       htmldiff.TrackChangesMarkup,
+		Author:       "Elliott",
+		AuthorID:     "42",
+		DateTime:     time.Date(2016, 5, 3, 12, 30, 0, 0, time.UTC),
+	}
+	res, err := tcCfg.HTMLdiff([]string{"<p>The quick brown fox jumped</p>", "<p>The <b>quick</b> fox jumped over</p>"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	attrs := `data-userid="42" data-username="Elliott" data-time="1462278600000" data-last-change-time="1462278600000"`
+	want := `<p>The <b><span class="ice-fmt ice-cts" data-cid="1" data-change-type="format" ` + attrs + `>quick</span></b>` +
+		` <del class="ice-del ice-cts" data-cid="2" data-change-type="delete" ` + attrs + `>brown </del>fox jumped<ins class="ice-ins ice-cts" data-cid="3" data-change-type="insert" ` + attrs + `> over</ins></p>`
+	if res[0] != want {
+		t.Errorf("track changes markup wanted: `%s` got: `%s`", want, res[0])
+	}
+}
+
+func TestResolve(t *testing.T) {
+	bbc := bbcNews1 + bbcNews2
+	pairs := [][]string{{doc2, doc3}, {doc3, doc4}, {doc4, doc2}, {bbc, bbcNews1 + "<div><i>HTML-Diff-Inserted</i></div>" + bbcNews2}}
+	for _, st := range simpleTests {
+		for v := 1; v < len(st.versions); v++ {
+			pairs = append(pairs, []string{st.versions[0], st.versions[v]})
+		}
+	}
+	for _, a := range resolveSnippets {
+		for _, b := range resolveSnippets {
+			if a != b {
+				pairs = append(pairs, []string{a, b})
+			}
+		}
+	}
+	for _, rc := range []*htmldiff.Config{cfg, {Tokenization: htmldiff.ByWord, DetectMoves: 3}, {Hierarchical: true, Granularity: 3}} {
+		for p, pair := range pairs {
+			for _, vv := range [][]string{pair, {pair[1], pair[0]}} {
+				changes, err := rc.Changes(vv)
+				if err != nil {
+					t.Fatal(err)
+				}
+				for i, accept := range []func(int) bool{htmldiff.RejectAll, htmldiff.AcceptAll} {
+					want := parsedBody(t, rc, vv[i])
+					got, err := htmldiff.Resolve(changes[0], accept)
+					if err != nil {
+						t.Fatal(err)
+					}
+					if got != want {
+						t.Errorf("pair %d resolving all (accept %t) wanted: `%s` got: `%s`", p, i == 1, want, got)
+					}
+				}
+			}
+		}
+	}
+
+	wordCfg := &htmldiff.Config{Tokenization: htmldiff.ByWord}
+	changes, err := wordCfg.Changes([]string{"<p>The quick brown fox jumped</p>", "<p>The <b>quick</b> fox jumped over</p>"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := htmldiff.Resolve(changes[0], htmldiff.AcceptIDs(3))
+	if want := "<p>The quick brown fox jumped over</p>"; got != want || err != nil {
+		t.Errorf("accepting only the insertion wanted: `%s` got: `%s` %v", want, got, err)
+	}
+	for _, pt := range partialTests {
+		changes, err := wordCfg.Changes(pt.versions)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for id, want := range pt.accepted {
+			got, err := htmldiff.Resolve(changes[0], htmldiff.AcceptIDs(id+1))
+			if got != want || err != nil {
+				t.Errorf("%v accepting only change %d wanted: `%s` got: `%s` %v", pt.versions, id+1, want, got, err)
+			}
+		}
+	}
+	calls := make(map[int]int)
+	if _, err := htmldiff.Resolve(changes[0], func(id int) bool { calls[id]++; return true }); err != nil {
+		t.Fatal(err)
+	}
+	for id, n := range calls {
+		if n != 1 {
+			t.Errorf("accept called %d times for change %d", n, id)
+		}
+	}
+	if _, err := htmldiff.Resolve([]htmldiff.Change{{Action: htmldiff.Inserted, ID: 1, New: "x"}}, htmldiff.AcceptAll); err != htmldiff.ErrNotResolvable {
+		t.Errorf("a change list not made by Changes wanted error %v got %v", htmldiff.ErrNotResolvable, err)
+	}
+}
+
+// partialTests give the result of accepting only each change in turn, by ID, when comparing by word.
+var partialTests = []struct {
+	versions, accepted []string
+}{
+	{[]string{"<p>a</p><p>b</p><p>c</p>", "<p>a</p><p>c</p><p>d</p>"},
+		[]string{"<p>a</p><p>c</p>", "<p>a</p><p>b</p><p>c</p><p>d</p>"}},
+	{[]string{"<p>Intro.</p><p>Body text.</p>", "<p>Intro.</p><p>Body text, edited.</p>"},
+		[]string{"<p>Intro.</p><p>Body text, edited.</p>"}},
+	{[]string{"<p>one</p>", "<p>one two</p><p>three</p>"},
+		[]string{"<p>one two</p>", "<p>one</p><p>three</p>"}},
+	{[]string{"<p>Intro.</p><p>Body text.</p>", "<p>Intro, revised.</p><p>Body text, edited.</p><p>New.</p>"},
+		[]string{"<p>Intro, revised.</p><p>Body text.</p>", "<p>Intro.</p><p>Body text, edited..</p>", "<p>Intro.</p><p>Body text</p><p>New.</p>"}},
+	{[]string{"<p>one two</p><p>three</p>", "<h1>one two</h1><p>three four</p>"},
+		[]string{"<p> two</p><p>three</p>", "<p>one</p><h1>one two</h1><p> two</p><p>three</p>",
+			"<p>one</p><p>three </p><p>two</p><p>three</p>", "<p>one </p><p>three</p>", "<p>one two</p>",
+			"<p>one two</p><p>three</p><p>four</p>"}},
+}
+
+// parsedBody gives the body of the HTML, as parsed and cleaned by the Config, to compare with the versions made by Resolve and Apply.
+func parsedBody(t *testing.T, c *htmldiff.Config, s string) string {
+	doc, err := html.Parse(strings.NewReader(s))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var clean func(n *html.Node)
+	clean = func(n *html.Node) {
+		for ch := n.FirstChild; ch != nil; {
+			next := ch.NextSibling
+			for _, tag := range c.CleanTags {
+				if ch.Type == html.ElementNode && ch.Data == tag {
+					n.RemoveChild(ch)
+				}
+			}
+			if ch.Parent == n {
+				clean(ch)
+			}
+			ch = next
+		}
+		attrs := n.Attr[:0]
+		for _, a := range n.Attr {
+			switch {
+			case a.Key == "style" && strings.TrimSpace(a.Val) == "":
+				continue
+			case a.Key == "style":
+				a.Val = strings.Replace(a.Val, " ", "", -1)
+				if !strings.HasSuffix(a.Val, ";") {
+					a.Val += ";"
+				}
+			case n.Data == "td" && a.Key == "colspan" && strings.TrimSpace(a.Val) == "1":
+				continue
+			}
+			attrs = append(attrs, a)
+		}
+		n.Attr = attrs
+		if n.Type == html.TextNode {
+			n.Data = htm.UnescapeString(n.Data)
+		}
+	}
+	clean(doc)
+	var body *html.Node
+	var find func(n *html.Node)
+	find = func(n *html.Node) {
+		for ch := n.FirstChild; ch != nil && body == nil; ch = ch.NextSibling {
+			if ch.Type == html.ElementNode && ch.Data == "body" {
+				body = ch
+			}
+			find(ch)
+		}
+	}
+	find(doc)
+	var buf bytes.Buffer
+	for n := body.FirstChild; n != nil; n = n.NextSibling {
+		if err := html.Render(&buf, n); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return buf.String()
+}
+
+// resolveSnippets are compared in every pair by TestResolve, including empty elements and leading or trailing images.
+var resolveSnippets = []string{
+	"", "<p></p>", "<p>x</p>", "<p>a</p>", "<p>a<img src=x></p>", "<p>a</p><img src=x>", "<img src=x><p>a</p>",
+	"<p>a</p><hr>", "<hr><p>a</p>", "<p>a <b>b</b> c</p>", "<p>a <i>b</i> c</p>", "<p>a</p><p>b</p>", "<h1>a</h1>",
+	"<ul><li>one</li><li>two</li></ul>", "<ul><li>one</li></ul>", "<table><tr><td>1</td><td>2</td></tr></table>",
+	"<table><tr><td>1</td></tr><tr><td>3</td></tr></table>", "<p><a href=x>link</a> text</p>", "<p><img src=y></p>",
+}
+
+func TestChain(t *testing.T) {
+	chainCfg := *cfg
+	chainCfg.Chain = true
+	versions := []string{"<p>abc</p>", "<p>abcdef</p>", "<p>def</p>"}
+	res, err := chainCfg.HTMLdiff(versions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for m := range res {
+		want, err := cfg.HTMLdiff(versions[m : m+2])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res[m] != want[0] {
+			t.Errorf("revision %d wanted: `%s` got: `%s`", m+1, want[0], res[m])
+		}
+	}
+}
+
+func TestBlame(t *testing.T) {
+	blameCfg := &htmldiff.Config{
+		Tokenization: htmldiff.ByWord,
+		DeletedSpan:  []htmldiff.Attribute{{Key: "class", Val: "deleted"}},
+	}
+	res, err := blameCfg.Blame([]htmldiff.Revision{
+		{HTML: "<p>The quick fox</p><ul><li>one</li></ul>", Author: "Ann"},
+		{HTML: "<p>The quick brown fox</p><ul><li>one</li><li>two</li></ul>", Author: "Bob"},
+		{HTML: "<p>The brown fox</p><ul><li>1</li><li>two</li></ul>", Author: "Cat"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ann, bob, cat := `data-revision="0" data-author="Ann"`, `data-revision="1" data-author="Bob"`, `data-revision="2" data-author="Cat"`
+	deleted := `class="deleted" ` + ann + ` data-deleted-revision="2" data-deleted-author="Cat"`
+	want := `<p><span ` + ann + `>The </span><span ` + deleted + `>quick </span><span ` + bob + `>brown </span><span ` + ann + `>fox</span></p>` +
+		`<ul><li><span ` + deleted + `>one</span><span ` + cat + `>1</span></li><li><span ` + bob + `>two</span></li></ul>`
+	if res != want {
+		t.Errorf("blame wanted: `%s` got: `%s`", want, res)
+	}
+}
+
+func TestMoves(t *testing.T) {
+	moveCfg := *cfg
+	moveCfg.Tokenization = htmldiff.ByWord
+	moveCfg.Hierarchical = true
+	moveCfg.DetectMoves = 10
+	moveCfg.MovedSpan = []htmldiff.Attribute{{Key: "class", Val: "moved"}}
+	versions := []string{"<p>First paragraph here.</p><p>Second paragraph, which moves.</p>",
+		"<p>Second paragraph, which moved.</p><p>First paragraph here.</p>"}
+	res, err := moveCfg.HTMLdiff(versions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `<p><span class="moved" data-move-id="1" data-move="to">Second paragraph, which moved.</span>First paragraph here.` +
+		`<span class="moved" data-move-id="1" data-move="from">Second paragraph, which moves.</span></p>`
+	if res[0] != want {
+		t.Errorf("moves wanted: `%s` got: `%s`", want, res[0])
+	}
+	changes, err := moveCfg.Changes(versions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var actions []string
+	for _, ch := range changes[0] {
+		actions = append(actions, fmt.Sprintf("%v %d", ch.Action, ch.ID))
+	}
+	if got := strings.Join(actions, ", "); got != "moved to 1, unchanged 0, moved from 1" {
+		t.Errorf("move changes got: %s", got)
+	}
+	moveCfg.Markup = htmldiff.TrackChangesMarkup
+	res, err = moveCfg.HTMLdiff(versions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, w := range []string{`<ins class="ice-ins ice-cts" data-cid="1-to" data-change-type="insert" data-move-id="1" data-move="to">`,
+		`<del class="ice-del ice-cts" data-cid="1-from" data-change-type="delete" data-move-id="1" data-move="from">`} {
+		if !strings.Contains(res[0], w) {
+			t.Errorf("track changes moves wanted `%s` in: `%s`", w, res[0])
+		}
+	}
+
+	// text deleted and inserted in the same place has not moved
+	moveCfg = *cfg
+	moveCfg.Tokenization = htmldiff.ByWord
+	moveCfg.DetectMoves = 5
+	changes, err = moveCfg.Changes([]string{"<p>Hello there world friend</p>", "<h1>Hello there world friends</h1>"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, ch := range changes[0] {
+		if ch.Action == htmldiff.MovedFrom || ch.Action == htmldiff.MovedTo {
+			t.Errorf("change in place marked as %v: %q%q", ch.Action, ch.Old, ch.New)
+		}
+	}
+}
+
+func TestMovesTimeout(t *testing.T) {
+	var a, b strings.Builder
+	for i := 0; i < 200; i++ {
+		fmt.Fprintf(&a, "<p>%s</p>", strings.Repeat(fmt.Sprintf("alpha%03d ", i), 20))
+		fmt.Fprintf(&b, "<p>%s</p>", strings.Repeat(fmt.Sprintf("omega%03d ", i), 20))
+	}
+	versions := []string{a.String(), b.String()}
+	// comparing by word is quick, so the time goes on comparing every deleted run with every inserted one
+	moveCfg := htmldiff.Config{DetectMoves: 10, Tokenization: htmldiff.ByWord, MaxDiffDuration: 200 * time.Millisecond}
+	start := time.Now()
+	if _, err := moveCfg.HTMLdiff(versions); err != htmldiff.ErrDiffTimeout {
+		t.Errorf("move detection past MaxDiffDuration got error: %v", err)
+	}
+	if d := time.Since(start); d > 2*time.Second {
+		t.Errorf("move detection took %v with a MaxDiffDuration of 200ms", d)
+	}
+
+	// with a Fallback allowed, the changes are kept without moves
+	moveCfg.Fallback = htmldiff.FallbackBlocks
+	res, err := moveCfg.HTMLdiffResults(context.Background(), versions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res[0].Err != nil || res[0].Fallback != htmldiff.FallbackBlocks || strings.Contains(res[0].HTML, "data-move") ||
+		!strings.Contains(res[0].HTML, "omega199") {
+		t.Errorf("move detection past MaxDiffDuration with a fallback got %d %v", res[0].Fallback, res[0].Err)
+	}
+
+	moveCfg.MaxDiffDuration = -1
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	start = time.Now()
+	if _, err := moveCfg.HTMLdiffContext(ctx, versions); err != context.DeadlineExceeded {
+		t.Errorf("move detection past the context deadline got error: %v", err)
+	}
+	if d := time.Since(start); d > 2*time.Second {
+		t.Errorf("move detection took %v with a context deadline of 200ms", d)
+	}
+}
+
+func TestAttrChanges(t *testing.T) {
+	attrCfg := *cfg
+	attrCfg.ShowAttrChanges = true
+	versions := []string{`<p>See <a href="a.html">the docs</a> and <img src="x.png" alt="x"></p>`,
+		`<p>See <a href="b.html">the docs</a> and <img src="y.png"></p>`}
+	changes, err := attrCfg.Changes(versions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, ch := range changes[0] {
+		for _, ac := range ch.Attrs {
+			got = append(got, ac.String())
+		}
+	}
+	want := `a href changed from "a.html" to "b.html"; img src changed from "x.png" to "y.png"; img alt removed "x"`
+	if strings.Join(got, "; ") != want {
+		t.Errorf("attribute changes wanted: %s got: %s", want, strings.Join(got, "; "))
+	}
+	res, err := attrCfg.HTMLdiff(versions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, w := range []string{`data-old-href="a.html" title="a href changed from &#34;a.html&#34; to &#34;b.html&#34;"`,
+		`data-old-src="x.png" data-old-alt="x"`} {
+		if !strings.Contains(res[0], w) {
+			t.Errorf("attribute changes wanted `%s` in: `%s`", w, res[0])
+		}
+	}
+	res, err = attrCfg.HTMLdiff([]string{`<div class="a"><span class="b">text</span></div>`, `<div class="c"><span class="d">text</span></div>`})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := strings.Count(res[0], "data-old-class="); n != 1 || !strings.Contains(res[0], `data-old-class="b"`) {
+		t.Errorf("attribute changes wanted one data-old-class=\"b\" in: `%s`", res[0])
+	}
+}
+
+func TestFormatChanges(t *testing.T) {
+	formatCfg := *cfg
+	formatCfg.ShowFormatChanges = true
+	versions := []string{`<p>Some <i>plain</i> text.</p><p>A heading</p>`,
+		`<p>Some <b>plain</b> text.</p><h1>A heading</h1>`}
+	changes, err := formatCfg.Changes(versions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, ch := range changes[0] {
+		for _, fc := range ch.Format {
+			got = append(got, fc.String())
+		}
+	}
+	want := "bold added, italic removed, moved into h1, moved out of p"
+	if strings.Join(got, ", ") != want {
+		t.Errorf("format changes wanted: %s got: %s", want, strings.Join(got, ", "))
+	}
+	res, err := formatCfg.HTMLdiff(versions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := `data-format="+b -i" title="bold added, italic removed"`
+	if !strings.Contains(res[0], w) {
+		t.Errorf("format changes wanted `%s` in: `%s`", w, res[0])
+	}
+}
+
+func TestDocuments(t *testing.T) {
+	versions := []string{`<!DOCTYPE html><html lang="en"><head><title>Old title</title><meta name="author" content="A">` +
+		`<link rel="stylesheet" href="a.css"><script src="a.js"></script></head><body class="page"><p>Some text.</p></body></html>`,
+		`<!DOCTYPE html><html lang="en"><head><title>New title</title><meta name="author" content="A">` +
+			`<meta name="description" content="D"><link rel="stylesheet" href="b.css"></head><body class="page"><p>Some more text.</p></body></html>`}
+	res, err := cfg.HTMLdiffDocuments(versions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `<!DOCTYPE html><html lang="en"><head><title>New title</title><meta name="author" content="A"/>` +
+		`<meta name="description" content="D"/><link rel="stylesheet" href="b.css"/></head><body class="page">` +
+		`<p>Some <span style="background-color: palegreen; text-decoration: underline;">more </span>text.</p></body></html>`
+	if res[0].HTML != want {
+		t.Errorf("document wanted: `%s` got: `%s`", want, res[0].HTML)
+	}
+	var got []string
+	for _, hc := range res[0].Head {
+		got = append(got, fmt.Sprintf("%v %s %s %q %q", hc.Action, hc.Element, hc.Key, hc.Old, hc.New))
+	}
+	wantHead := `replaced title  "Old title" "New title", inserted meta description "" "D", inserted link stylesheet "" "b.css", ` +
+		`deleted link stylesheet "a.css" "", deleted script src "a.js" ""`
+	if strings.Join(got, ", ") != wantHead {
+		t.Errorf("head changes wanted: %s got: %s", wantHead, strings.Join(got, ", "))
+	}
+
+	del := `<span style="` + cfg.DeletedSpan[0].Val + `">`
+	ins := `<span style="` + cfg.InsertedSpan[0].Val + `">`
+	for _, dt := range documentBodyTests {
+		res, err := cfg.HTMLdiffDocuments(dt.versions)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := "<html><head></head><body>" + strings.NewReplacer("{del}", del, "{ins}", ins, "{rep}", `<span style="`+cfg.ReplacedSpan[0].Val+`">`).Replace(dt.body) + "</body></html>"
+		if res[0].HTML != want {
+			t.Errorf("document body wanted: `%s` got: `%s`", want, res[0].HTML)
+		}
+	}
+
+	// HTMLdiff gives only the body, which should not be misaligned by the different titles
+	body, err := cfg.HTMLdiff([]string{"<html><head><title>Old title</title></head><body><p>Some text here.</p></body></html>",
+		"<html><head><title>A quite different new title</title></head><body><p>Some text here, edited.</p></body></html>"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `<p>Some text here` + ins + `, edited</span>.</p>`; body[0] != want {
+		t.Errorf("whole documents wanted: `%s` got: `%s`", want, body[0])
+	}
+}
+
+// documentBodyTests have bodies which start with an element, or have no text, with the merged body wanted,
+// where {del}, {ins} and {rep} stand for the change spans.
+var documentBodyTests = []struct {
+	versions []string
+	body     string
+}{
+	{[]string{"<html><body><img src=x><p>a</p></body></html>", "<html><body><img src=y><p>a</p></body></html>"}, `{rep}<img src="y"/></span><p>a</p>`},
+	{[]string{"<html><body><hr><p>a</p></body></html>", "<html><body><p>a</p></body></html>"}, `{del}<hr/></span><p>a</p>`},
+	{[]string{"<html><body><p>a</p></body></html>", "<html><body></body></html>"}, `<p>{del}a</span></p>`},
+	{[]string{"<html><body></body></html>", "<html><body><p>a</p></body></html>"}, `<p>{ins}a</span></p>`},
+	{[]string{"<html><body></body></html>", "<html><body></body></html>"}, ``},
+	{[]string{"<html><body><img src=x></body></html>", "<html><body><img src=x><img src=z></body></html>"}, `<img src="x"/>{ins}<img src="z"/></span>`},
+}
+
+func TestFragmentContext(t *testing.T) {
+	fragCfg := *cfg
+	for _, ft := range []struct {
+		context       string
+		versions      []string
+		want, resolve string
+	}{
+		{"tbody", []string{"<tr><td>a</td><td>b</td></tr><tr><td>c</td></tr>", "<tr><td>a</td><td>B</td></tr><tr><td>c</td></tr><tr><td>d</td></tr>"},
+			`<tr><td>a</td><td><span style="background-color: lightpink; text-decoration: line-through;">b</span>` +
+				`<span style="background-color: palegreen; text-decoration: underline;">B</span></td></tr><tr><td>c</td></tr>` +
+				`<tr><td><span style="background-color: palegreen; text-decoration: underline;">d</span></td></tr>`,
+			"<tr><td>a</td><td>B</td></tr><tr><td>c</td></tr><tr><td>d</td></tr>"},
+		{"ul", []string{"<li>one</li><li>two</li>", "<li>one</li><li>two</li><li>three</li>"},
+			`<li>one</li><li>two</li><li><span style="background-color: palegreen; text-decoration: underline;">three</span></li>`,
+			"<li>one</li><li>two</li><li>three</li>"},
+	} {
+		fragCfg.FragmentContext = ft.context
+		res, err := fragCfg.HTMLdiff(ft.versions)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res[0] != ft.want {
+			t.Errorf("fragment in %s wanted: `%s` got: `%s`", ft.context, ft.want, res[0])
+		}
+		changes, err := fragCfg.Changes(ft.versions)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resolved, err := htmldiff.Resolve(changes[0], htmldiff.AcceptAll)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resolved != ft.resolve {
+			t.Errorf("fragment in %s resolved wanted: `%s` got: `%s`", ft.context, ft.resolve, resolved)
+		}
+	}
+}
+
+func TestWriteHTMLdiff(t *testing.T) {
+	versions := []string{"<p>The <b>quick</b> fox.</p>", "<p>The <b>quick</b> brown fox.</p>", "<p>The <i>quick</i> fox.</p>"}
+	want, err := cfg.HTMLdiff(versions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tree := &htmldiff.Node{Type: htmldiff.ElementNode, Data: "p", Children: []*htmldiff.Node{
+		{Type: htmldiff.TextNode, Data: "The "},
+		{Type: htmldiff.ElementNode, Data: "i", Children: []*htmldiff.Node{{Type: htmldiff.TextNode, Data: "quick"}}},
+		{Type: htmldiff.TextNode, Data: " fox."},
+	}}
+	var w1, w2 bytes.Buffer
+	err = cfg.WriteHTMLdiff(context.Background(), []htmldiff.Version{
+		htmldiff.StringVersion(versions[0]),
+		htmldiff.ReaderVersion(strings.NewReader(versions[1])),
+		htmldiff.NodeVersion(tree),
+	}, []io.Writer{&w1, &w2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, got := range []string{w1.String(), w2.String()} {
+		if got != want[i] {
+			t.Errorf("written diff %d wanted: `%s` got: `%s`", i, want[i], got)
+		}
+	}
+	rv := htmldiff.ReaderVersion(strings.NewReader(versions[1]))
+	err = cfg.WriteHTMLdiff(context.Background(), []htmldiff.Version{htmldiff.StringVersion(versions[0]), rv, rv}, []io.Writer{&w1, &w2})
+	if err == nil {
+		t.Error("no error for a ReaderVersion given twice")
+	}
+	err = cfg.WriteHTMLdiff(context.Background(), []htmldiff.Version{htmldiff.StringVersion(versions[0]), rv}, []io.Writer{&w1})
+	if err == nil {
+		t.Error("no error for a ReaderVersion used again")
+	}
+	err = cfg.WriteHTMLdiff(context.Background(), []htmldiff.Version{htmldiff.StringVersion(versions[0]), htmldiff.StringVersion(versions[1])}, nil)
+	if err == nil {
+		t.Error("no error for too few writers")
+	}
+
+	// when one edit fails, the others must stop writing before WriteHTMLdiff returns
+	limitCfg := *cfg
+	limitCfg.MaxRunes = 10000
+	var writing int32
+	vv := []htmldiff.Version{htmldiff.StringVersion(doc2), htmldiff.StringVersion(bbcNews1 + bbcNews2)}
+	ws := []io.Writer{ioutil.Discard}
+	for i := 0; i < 4; i++ {
+		vv = append(vv, htmldiff.StringVersion(doc3))
+		ws = append(ws, slowWriter{&writing})
+	}
+	if err := limitCfg.WriteHTMLdiff(context.Background(), vv, ws); err != htmldiff.ErrInputTooLarge {
+		t.Errorf("wanted error %v got %v", htmldiff.ErrInputTooLarge, err)
+	}
+	if atomic.LoadInt32(&writing) != 0 {
+		t.Error("writing continued after WriteHTMLdiff returned")
+	}
+}
+
+// slowWriter counts the writes in progress.
+type slowWriter struct {
+	writing *int32
+}
+
+func (sw slowWriter) Write(p []byte) (int, error) {
+	atomic.AddInt32(sw.writing, 1)
+	defer atomic.AddInt32(sw.writing, -1)
+	time.Sleep(time.Millisecond)
+	return len(p), nil
+}
+
+func TestHTMLdiffBytes(t *testing.T) {
+	latin1 := []byte("<html><head><meta charset=\"iso-8859-1\"></head><body><p>Caf\xe9 cr\xe8me</p></body></html>")
+	shiftJIS := []byte("<html><head><meta http-equiv=\"Content-Type\" content=\"text/html; charset=Shift_JIS\"></head>" +
+		"<body><p>\x93\xfa\x96\x7b</p></body></html>") // 日本
+	utf8BOM := []byte("\xef\xbb\xbf<p>Café crème brûlée</p>")
+	for _, bt := range []struct {
+		versions [][]byte
+		want     string
+	}{
+		{[][]byte{latin1, utf8BOM}, `<p>Café crème<span style="background-color: palegreen; text-decoration: underline;"> brûlée</span></p>`},
+		{[][]byte{shiftJIS, []byte("<p>日本</p>")}, "<p>日本</p>"},
+		{[][]byte{[]byte("<html><body><p>a</p></body></html>"), []byte("<html><body></body></html>")},
+			`<p><span style="background-color: lightpink; text-decoration: line-through;">a</span></p>`},
+	} {
+		res, err := cfg.HTMLdiffBytes(bt.versions)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res[0] != bt.want {
+			t.Errorf("bytes diff wanted: `%s` got: `%s`", bt.want, res[0])
+		}
+		// BytesVersion with WriteHTMLdiff should give the same, however many times the versions are used
+		vv := []htmldiff.Version{htmldiff.BytesVersion(bt.versions[0]), htmldiff.BytesVersion(bt.versions[1])}
+		for i := 0; i < 2; i++ {
+			var w bytes.Buffer
+			if err = cfg.WriteHTMLdiff(context.Background(), vv, []io.Writer{&w}); err != nil {
+				t.Fatal(err)
+			}
+			if w.String() != bt.want {
+				t.Errorf("bytes versions written (use %d) wanted: `%s` got: `%s`", i+1, bt.want, w.String())
+			}
+		}
+	}
+}
+
+func TestDiffer(t *testing.T) {
+	base := doc2
+	edits := []string{doc3, doc4, doc2, "<p>Something else entirely.</p>"}
+	hierCfg := *cfg
+	hierCfg.Hierarchical = true
+	for _, dc := range []*htmldiff.Config{cfg, &hierCfg} {
+		differ, err := dc.NewDiffer(base)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want, err := dc.HTMLdiff(append([]string{base}, edits...))
+		if err != nil {
+			t.Fatal(err)
+		}
+		errs := make(chan error, len(edits))
+		for e := range edits {
+			go func(e int) { // the base is shared between the goroutines
+				got, err := differ.HTMLdiff(edits[e])
+				if err == nil && got != want[e] {
+					err = fmt.Errorf("differ (hierarchical %t) edit %d wanted: `%s` got: `%s`", dc.Hierarchical, e, want[e], got)
+				}
+				errs <- err
+			}(e)
+		}
+		for range edits {
+			if err := <-errs; err != nil {
+				t.Error(err)
+			}
+		}
+		wantChanges, err := dc.Changes(append([]string{base}, edits...))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for e, edit := range edits {
+			got, err := differ.Changes(edit)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(got) != len(wantChanges[e]) {
+				t.Errorf("differ (hierarchical %t) changes %d wanted %d got %d", dc.Hierarchical, e, len(wantChanges[e]), len(got))
+				continue
+			}
+			for i, ch := range got {
+				if w := wantChanges[e][i]; ch.Action != w.Action || ch.ID != w.ID || ch.Old != w.Old || ch.New != w.New {
+					t.Errorf("differ (hierarchical %t) changes %d,%d wanted: %v %d `%s` `%s` got: %v %d `%s` `%s`",
+						dc.Hierarchical, e, i, w.Action, w.ID, w.Old, w.New, ch.Action, ch.ID, ch.Old, ch.New)
+				}
+			}
+		}
+	}
+
+	// a base which is only compared by its body, with its segments prepared in advance
+	differ, err := hierCfg.NewDifferContext(context.Background(), htmldiff.BytesVersion([]byte(base)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, edit := range edits {
+		want, err := hierCfg.HTMLdiffBytes([][]byte{[]byte(base), []byte(edit)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := differ.HTMLdiffContext(context.Background(), htmldiff.BytesVersion([]byte(edit)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != want[0] {
+			t.Errorf("differ of bytes wanted: `%s` got: `%s`", want[0], got)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := differ.ChangesContext(ctx, htmldiff.StringVersion(doc3)); err != context.Canceled {
+		t.Errorf("ChangesContext with a cancelled context should give error %v got %v", context.Canceled, err)
+	}
+}
+
+func TestMaxConcurrency(t *testing.T) {
+	versions := []string{doc2, doc3, doc4, doc2, "<p>Something else entirely.</p>"}
+	want, err := cfg.HTMLdiff(versions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, max := range []int32{1, 2} {
+		var running, most int32
+		poolCfg := *cfg
+		poolCfg.MaxConcurrency = int(max)
+		poolCfg.Tokenizer = htmldiff.TokenizerFunc(func(text string) []string { // measures how many versions are parsed at once
+			r := atomic.AddInt32(&running, 1)
+			defer atomic.AddInt32(&running, -1)
+			for m := atomic.LoadInt32(&most); r > m && !atomic.CompareAndSwapInt32(&most, m, r); m = atomic.LoadInt32(&most) {
+			}
+			time.Sleep(time.Microsecond)
+			return strings.Split(text, "")
+		})
+		got, err := poolCfg.HTMLdiff(versions)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := range want {
+			if got[i] != want[i] {
+				t.Errorf("MaxConcurrency %d diff %d wanted: `%s` got: `%s`", max, i, want[i], got[i])
+			}
+		}
+		if most > max {
+			t.Errorf("MaxConcurrency %d exceeded, %d versions parsed at once", max, most)
+		}
+	}
+}
+
+func TestMerge(t *testing.T) {
+	mergeCfg := &htmldiff.Config{
+		Tokenization:       htmldiff.ByWord,
+		ConflictOursSpan:   []htmldiff.Attribute{{Key: "class", Val: "ours"}},
+		ConflictTheirsSpan: []htmldiff.Attribute{{Key: "class", Val: "theirs"}},
+	}
+	fox := "<p>The quick brown fox jumped over the lazy dog.</p><ul><li>one</li><li>two</li></ul>"
+	for _, mt := range []struct {
+		base, ours, theirs, want string
+		conflicts                int
+	}{
+		{fox, "<p>The slow brown fox jumped over the lazy dog.</p><ul><li>one</li><li>two</li></ul>",
+			"<p>The quick brown fox jumped over the sleepy dog.</p><ul><li>one</li><li>two</li><li>three</li></ul>",
+			"<p>The slow brown fox jumped over the sleepy dog.</p><ul><li>one</li><li>two</li><li>three</li></ul>", 0},
+		{fox, "<p>The quick red fox jumped over the lazy dog.</p><ul><li>one</li><li>two</li></ul>",
+			"<p>The quick black fox jumped over the lazy dog.</p><ul><li>one</li><li>2</li></ul>",
+			`<p>The quick <span class="ours">red</span><span class="theirs">black</span> fox jumped over the lazy dog.</p><ul><li>one</li><li>2</li></ul>`, 1},
+		{fox, "<p>The quick red fox jumped over the lazy dog.</p><ul><li>one</li><li>two</li></ul>",
+			"<p>The quick red fox jumped over the lazy dog.</p><ul><li>one</li><li>two</li></ul>",
+			"<p>The quick red fox jumped over the lazy dog.</p><ul><li>one</li><li>two</li></ul>", 0},
+		{"<p>Intro.</p><p>Body text.</p>", "<p>Intro.</p><p>Body text, edited.</p>", "<p>Intro.</p><p>Body text.</p>",
+			"<p>Intro.</p><p>Body text, edited.</p>", 0},
+		{"<p>Intro.</p><p>Body text.</p>", "<p>Intro.</p><p>Body text.</p>", "<p>Intro.</p><p>Body text.</p><p>More.</p>",
+			"<p>Intro.</p><p>Body text.</p><p>More.</p>", 0},
+		{"<p>abc</p>", "<p>abc</p><p>x</p>", "<p>abc</p>", "<p>abc</p><p>x</p>", 0},
+		{"<p>abc</p>", "<p>abc</p><p>x</p>", "<p>abc</p><p>y</p>",
+			`<p>abc</p><p><span class="ours">x</span></p><p><span class="theirs">y</span></p>`, 1},
+		{"<html><head><title>Base</title></head><body><p>One two.</p><p>Three four.</p></body></html>",
+			"<html><head><title>Ours</title></head><body><p>Uno two.</p><p>Three four.</p></body></html>",
+			"<html><head><title>Theirs</title></head><body><p>One two.</p><p>Three four, five.</p></body></html>",
+			"<p>Uno two.</p><p>Three four, five.</p>", 0},
+	} {
+		merged, conflicts, err := mergeCfg.Merge(mt.base, mt.ours, mt.theirs)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if merged != mt.want || conflicts != mt.conflicts {
+			t.Errorf("merge wanted: `%s` with %d conflicts got: `%s` with %d", mt.want, mt.conflicts, merged, conflicts)
+		}
+		if marked := strings.Contains(merged, `class="ours"`); marked != (conflicts > 0) {
+			t.Errorf("merge gave %d conflicts but conflict markup %t: `%s`", conflicts, marked, merged)
+		}
+	}
+}
+
+func TestPatch(t *testing.T) {
+	tests := append(simpleTests, simpleTest{versions: []string{doc2, doc3, doc4}},
+		simpleTest{versions: []string{"<p>Intro.</p><p>Body text.</p>", "<p>Intro.</p><p>Body text, edited.</p>",
+			"<p>Intro.</p><p>Body text.</p><p>More.</p>", "<p>Body text.</p>", "<h1>Intro.</h1><p>Body</p><p>text.</p>"}})
+	for _, a := range resolveSnippets {
+		tests = append(tests, simpleTest{versions: append([]string{a}, resolveSnippets...)})
+	}
+	for _, st := range tests {
+		for _, v := range st.versions[1:] {
+			for _, pair := range [][]string{{st.versions[0], v}, {v, st.versions[0]}} {
+				patch, err := cfg.Diff(pair[0], pair[1])
+				if err != nil {
+					t.Fatal(err)
+				}
+				js, err := json.Marshal(patch)
+				if err != nil {
+					t.Fatal(err)
+				}
+				var stored htmldiff.Patch
+				if err := json.Unmarshal(js, &stored); err != nil {
+					t.Fatal(err)
+				}
+				for i, pp := range []*htmldiff.Patch{&stored, htmldiff.Invert(&stored)} {
+					want := parsedBody(t, cfg, pair[1-i])
+					got, err := cfg.Apply(pair[i], pp)
+					if err != nil {
+						t.Fatal(err)
+					}
+					if got != want {
+						t.Errorf("applying patch (inverted %t) `%s` wanted: `%s` got: `%s`", i == 1, js, want, got)
+					}
+				}
+			}
+		}
+	}
+	patch, err := cfg.Diff("<p>abc</p>", "<p>abd</p>")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, wrong := range []string{"<p>xyz</p>", "<h1>abc</h1>", "<p><b>abc</b></p>", `<p class="x">abc</p>`, "<p>x</p><p>abc</p>"} {
+		if _, err := cfg.Apply(wrong, patch); err != htmldiff.ErrPatchMismatch {
+			t.Errorf("applying a patch to the wrong HTML `%s` wanted error %v got %v", wrong, htmldiff.ErrPatchMismatch, err)
+		}
+	}
+	want := "<p>abc</p>"
+	for i, pp := range []*htmldiff.Patch{nil, htmldiff.Invert(nil), {}} {
+		got, err := cfg.Apply("<p>abc</p>", pp)
+		if err != nil || got != want {
+			t.Errorf("applying an empty patch (%d) wanted: `%s` got: `%s` error %v", i, want, got, err)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := cfg.DiffContext(ctx, "<p>abc</p>", "<p>abd</p>"); err != context.Canceled {
+		t.Errorf("DiffContext with a cancelled context should give error %v got %v", context.Canceled, err)
+	}
+	if _, err := cfg.ApplyContext(ctx, "<p>abc</p>", patch); err != context.Canceled {
+		t.Errorf("ApplyContext with a cancelled context should give error %v got %v", context.Canceled, err)
+	}
+}
+
 func TestTimeoutAndMemory(t *testing.T) {
 	dir := "." + string(os.PathSeparator) + "testin"
 	files, err := ioutil.ReadDir(dir)
@@ -361,9 +1475,29 @@ func testToMem(testHTML, names []string, t *testing.T) {
 		args := []string{testHTML[f], strings.ToLower(testHTML[f])}
 		_, err := cfg.HTMLdiff(args) // don't care about the result as we are looking for crashes and time-outs
 		if err != nil {
-			if names[f] != "google.html" && names[f] != "bing.html" { // we expect errors on these two
+			if (names[f] != "google.html" && names[f] != "bing.html") || // we expect errors on these two
+				(err != htmldiff.ErrInputTooLarge && err != htmldiff.ErrDiffTimeout) {
 				t.Errorf("comparing %s with its lower-case self error: %s", names[f], err)
 			}
 		}
 	}
 }
+
+func TestContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := cfg.HTMLdiffContext(ctx, []string{"abc", "abd"}); err != context.Canceled {
+		t.Errorf("cancelled context should give error %v got %v", context.Canceled, err)
+	}
+
+	bbc := bbcNews1 + bbcNews2
+	ctx, cancel = context.WithTimeout(context.Background(), time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, err := cfg.HTMLdiffContext(ctx, []string{bbc, strings.ToUpper(bbc)}); err != context.DeadlineExceeded {
+		t.Errorf("expired context should give error %v got %v", context.DeadlineExceeded, err)
+	}
+	if took := time.Since(start); took > time.Second {
+		t.Errorf("expired context took %v to return", took)
+	}
+}
@@ -0,0 +1,138 @@
+package htmldiff
+
+import (
+	"context"
+	"io"
+	"strings"
+	"sync/atomic"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// NodeType is the type of a Node, with the same values as in "golang.org/x/net/html".
+type NodeType uint32
+
+// The types of Node.
+const (
+	ErrorNode NodeType = iota
+	TextNode
+	DocumentNode
+	ElementNode
+	CommentNode
+	DoctypeNode
+)
+
+// Node exists so that this package does not export html.Node, to allow vendoring of "golang.org/x/net/html".
+// It is an HTML node tree, which has already been parsed, for use as a Version.
+type Node struct {
+	Type      NodeType
+	Data      string // the text of a TextNode or CommentNode, or the name of an ElementNode or DoctypeNode
+	Namespace string
+	Attr      []Attribute
+	Children  []*Node
+}
+
+// Version is one version of the HTML to compare, which may be a string, read from an io.Reader, or a Node tree already parsed.
+type Version struct {
+	s        string
+	r        *onceReader
+	b        []byte // for BytesVersion, decoded when parsed
+	tree     *Node
+	bodyOnly bool // compare only the body of this version, see BytesVersion
+}
+
+// onceReader holds the io.Reader of a ReaderVersion, which may only be read by one parse.
+type onceReader struct {
+	r    io.Reader
+	used int32
+}
+
+// take returns the io.Reader, or nil if it has already been taken.
+func (o *onceReader) take() io.Reader {
+	if !atomic.CompareAndSwapInt32(&o.used, 0, 1) {
+		return nil
+	}
+	return o.r
+}
+
+// StringVersion returns a Version of the HTML held in a string.
+func StringVersion(s string) Version {
+	return Version{s: s}
+}
+
+// ReaderVersion returns a Version of the HTML to be read from r.
+// The reader is used up by the first parse, so the Version may only be compared once: giving it again,
+// in the same call or another, returns an error rather than comparing an empty document.
+func ReaderVersion(r io.Reader) Version {
+	return Version{r: &onceReader{r: r}}
+}
+
+// NodeVersion returns a Version of the HTML already parsed into a Node tree. A DocumentNode is used as it is,
+// any other Node is treated as a fragment within the body (or the Config.FragmentContext element).
+// The tree is copied, not changed.
+func NodeVersion(n *Node) Version {
+	return Version{tree: n}
+}
+
+// stringVersions converts the versions given as strings.
+func stringVersions(versions []string) []Version {
+	ret := make([]Version, len(versions))
+	for v, vv := range versions {
+		ret[v] = StringVersion(vv)
+	}
+	return ret
+}
+
+// WriteHTMLdiff finds all the differences in the versions of HTML, in the same way as HTMLdiffContext,
+// but writes each merged HTML snippit to the io.Writer for that edit, rather than returning strings.
+// There must be one io.Writer for each edit, that is one fewer than the versions. They are written concurrently,
+// but all writing has stopped by the time WriteHTMLdiff returns. On error, some writers may hold partial output.
+func (c *Config) WriteHTMLdiff(ctx context.Context, versions []Version, ws []io.Writer) error {
+	if len(versions) < 2 {
+		return errTooFewVersions
+	}
+	if len(ws) != len(versions)-1 {
+		return errWriterCount
+	}
+	return c.compareVersions(ctx, versions, func(m int, ap *appendContext) error {
+		return ap.renderTo(ctx, ws[m])
+	})
+}
+
+// htmlTree converts a Node tree into a new html.Node tree, within a document if it is not one already.
+func (c *Config) htmlTree(n *Node) (*html.Node, error) {
+	tree := htmlNode(n)
+	if tree.Type == html.DocumentNode {
+		return tree, nil
+	}
+	doc, err := c.parseHTML(strings.NewReader(""))
+	if err != nil {
+		return nil, err
+	}
+	parent := findBody(doc)
+	if c.FragmentContext != "" && c.FragmentContext != "body" {
+		parent = parent.FirstChild // the context element, see parseHTML
+	}
+	parent.AppendChild(tree)
+	return doc, nil
+}
+
+// htmlNode returns the "golang.org/x/net/html" version of a Node tree.
+func htmlNode(n *Node) *html.Node {
+	ret := &html.Node{
+		Type:      html.NodeType(n.Type),
+		Data:      n.Data,
+		Namespace: n.Namespace,
+		Attr:      convertAttributes(n.Attr),
+	}
+	if ret.Type == html.ElementNode && ret.Namespace == "" {
+		ret.DataAtom = atom.Lookup([]byte(n.Data))
+	}
+	for _, ch := range n.Children {
+		if ch != nil {
+			ret.AppendChild(htmlNode(ch))
+		}
+	}
+	return ret
+}
@@ -0,0 +1,107 @@
+package htmldiff
+
+import (
+	"strconv"
+	"time"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// Markup describes the elements used to mark the changes in the merged HTML.
+// With InsDelMarkup, formatting-only changes are still marked by a <span> with the ReplacedSpan attributes,
+// which should include a class or style to distinguish them; if there are none, the span has the class "format-change".
+type Markup int
+
+// The kinds of Markup available.
+const (
+	SpanMarkup   Markup = iota // <span> elements with the InsertedSpan, DeletedSpan or ReplacedSpan attributes
+	InsDelMarkup               // <ins> and <del> elements with the InsertedSpan or DeletedSpan attributes, plus Cite and DateTime
+
+	// TrackChangesMarkup gives <ins> and <del> elements (or <span> for formatting-only changes) with the classes and
+	// data attributes used by the ICE and LITE track-changes editor plugins: the change id, the Author and AuthorID,
+	// the DateTime in milliseconds and the type of change, so that the changes can be accepted or rejected in an editor.
+	// The span attributes given in the Config are not used.
+	TrackChangesMarkup
+)
+
+// The change types given in the data-change-type attribute of TrackChangesMarkup.
+var changeTypes = map[rune]string{'+': "insert", '-': "delete", '~': "format"}
+
+// changeNode returns a new element to wrap a change with the given action and id.
+func (c *Config) changeNode(action rune, id int) *html.Node {
+	n := &html.Node{
+		Type:     html.ElementNode,
+		DataAtom: atom.Span,
+		Data:     "span",
+	}
+	switch action {
+	case '<':
+		n.Attr = convertAttributes(c.ConflictOursSpan)
+		return n
+	case '>':
+		n.Attr = convertAttributes(c.ConflictTheirsSpan)
+		return n
+	case '{', '}':
+		return c.moveNode(action, id)
+	}
+	if c.Markup == TrackChangesMarkup {
+		return c.trackChangesNode(n, action, strconv.Itoa(id))
+	}
+	switch action {
+	case '+':
+		n.Attr = convertAttributes(c.InsertedSpan)
+	case '-':
+		n.Attr = convertAttributes(c.DeletedSpan)
+	case '~':
+		n.Attr = convertAttributes(c.ReplacedSpan)
+		if c.Markup == InsDelMarkup && len(n.Attr) == 0 {
+			n.Attr = []html.Attribute{{Key: "class", Val: "format-change"}}
+		}
+	}
+	if c.Markup == InsDelMarkup && (action == '+' || action == '-') {
+		c.insDelNode(n, action)
+	}
+	return n
+}
+
+// insDelNode makes n into an <ins> or <del> element for InsDelMarkup, given the action '+' or '-'.
+func (c *Config) insDelNode(n *html.Node, action rune) {
+	n.DataAtom, n.Data = atom.Ins, "ins"
+	if action == '-' {
+		n.DataAtom, n.Data = atom.Del, "del"
+	}
+	if c.Cite != "" {
+		n.Attr = append(n.Attr, html.Attribute{Key: "cite", Val: c.Cite})
+	}
+	if !c.DateTime.IsZero() {
+		n.Attr = append(n.Attr, html.Attribute{Key: "datetime", Val: c.DateTime.Format(time.RFC3339)})
+	}
+}
+
+// trackChangesNode makes n into an element for TrackChangesMarkup, with the change id cid.
+func (c *Config) trackChangesNode(n *html.Node, action rune, cid string) *html.Node {
+	class := "ice-fmt"
+	switch action {
+	case '+':
+		n.DataAtom, n.Data, class = atom.Ins, "ins", "ice-ins"
+	case '-':
+		n.DataAtom, n.Data, class = atom.Del, "del", "ice-del"
+	}
+	n.Attr = []html.Attribute{
+		{Key: "class", Val: class + " ice-cts"},
+		{Key: "data-cid", Val: cid},
+		{Key: "data-change-type", Val: changeTypes[action]},
+	}
+	if c.AuthorID != "" {
+		n.Attr = append(n.Attr, html.Attribute{Key: "data-userid", Val: c.AuthorID})
+	}
+	if c.Author != "" {
+		n.Attr = append(n.Attr, html.Attribute{Key: "data-username", Val: c.Author})
+	}
+	if !c.DateTime.IsZero() {
+		ms := strconv.FormatInt(c.DateTime.UnixNano()/int64(time.Millisecond), 10)
+		n.Attr = append(n.Attr, html.Attribute{Key: "data-time", Val: ms}, html.Attribute{Key: "data-last-change-time", Val: ms})
+	}
+	return n
+}
@@ -0,0 +1,174 @@
+package htmldiff
+
+import (
+	"context"
+	"sort"
+
+	"github.com/mb0/diff"
+)
+
+// Merge combines two concurrent edits of the same base HTML, ours and theirs, into one merged HTML snippit.
+// Changes made by only one of the edits are applied without markup. Where both edits change the same part of the base
+// differently, the two versions of that part are given one after the other, ours first, wrapped in span tags with the
+// ConflictOursSpan and ConflictTheirsSpan attributes, and counted in the number of conflicts returned.
+// For whole documents, only the bodies are merged.
+func (c *Config) Merge(base, ours, theirs string) (merged string, conflicts int, err error) {
+	return c.MergeContext(context.Background(), base, ours, theirs)
+}
+
+// MergeContext is the same as Merge, except that the work stops as soon as ctx is done, returning ctx.Err().
+func (c *Config) MergeContext(ctx context.Context, base, ours, theirs string) (merged string, conflicts int, err error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel() // on error return, stop any work still in progress
+	sources, err := c.parseVersions(ctx, stringVersions([]string{base, ours, theirs}))
+	if err != nil {
+		return "", 0, err
+	}
+	sources = c.bodies(sources) // the head is not merged, so it must not give conflicts
+
+	edits := make([][]diff.Change, 2)
+	err = c.parallel(ctx, len(edits), func(ctx context.Context, e int) (err error) {
+		edits[e], _, err = c.diffSources(ctx, sources[0], sources[e+1])
+		return err
+	})
+	if err != nil {
+		return "", 0, err
+	}
+
+	ap, conflicts := c.mergeChanges(sources, edits[0], edits[1])
+	merged, err = ap.render(ctx)
+	if err != nil {
+		return "", 0, err
+	}
+	return merged, conflicts, nil
+}
+
+// hunk is a change made by one side of a merge, with side 1 for ours and 2 for theirs, the index of its source.
+type hunk struct {
+	diff.Change
+	side int
+}
+
+// mergeChanges applies the changes from the base to ours and from the base to theirs to the base,
+// returning the edits to make the merged HTML and the number of conflicts found.
+func (c *Config) mergeChanges(sources []*source, ours, theirs []diff.Change) (*appendContext, int) {
+	hunks := make([]hunk, 0, len(ours)+len(theirs))
+	for _, ch := range ours {
+		hunks = append(hunks, hunk{ch, 1})
+	}
+	for _, ch := range theirs {
+		hunks = append(hunks, hunk{ch, 2})
+	}
+	sort.Stable(byBase(hunks))
+
+	base := *sources[0].treeRunes
+	app := &appendContext{c: c, pairs: newNodePairs(sources[0].tree)}
+	app.pairs.addChanges(base, *sources[1].treeRunes, ours)
+	app.pairs.addChanges(base, *sources[2].treeRunes, theirs)
+	conflicts := 0
+	baseIdx := sources[0].firstLeaf
+	for h := 0; h < len(hunks); {
+		// gather the hunks which overlap in the base, from either side
+		first := h
+		lo, hi := hunks[h].A, hunks[h].A+hunks[h].Del
+		for h++; h < len(hunks) && hunks[h].A <= hi; h++ { // touching changes are also gathered, as with text merges
+			if end := hunks[h].A + hunks[h].Del; end > hi {
+				hi = end
+			}
+		}
+		group := hunks[first:h]
+		for ; baseIdx < lo; baseIdx++ {
+			app.append('=', base, baseIdx, nil)
+		}
+		oursRunes := mergeSide(sources, group, 1, lo, hi)
+		theirsRunes := mergeSide(sources, group, 2, lo, hi)
+		switch {
+		case oneSided(group, 2), sameRunes(oursRunes, theirsRunes):
+			appendRunes(app, '=', oursRunes)
+		case oneSided(group, 1):
+			appendRunes(app, '=', theirsRunes)
+		default:
+			conflicts++
+			appendRunes(app, '<', oursRunes)
+			appendRunes(app, '>', theirsRunes)
+		}
+		if hi > baseIdx {
+			baseIdx = hi
+		}
+	}
+	for ; baseIdx < len(base); baseIdx++ {
+		app.append('=', base, baseIdx, nil)
+	}
+	app.flush()
+	sort.Stable(app)
+	app.numberChanges()
+	return app, conflicts
+}
+
+// byBase sorts hunks by where they start in the base.
+type byBase []hunk
+
+func (s byBase) Len() int           { return len(s) }
+func (s byBase) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s byBase) Less(i, j int) bool { return s[i].A < s[j].A }
+
+// oneSided returns true if none of the hunks are from the other side.
+func oneSided(group []hunk, other int) bool {
+	for _, h := range group {
+		if h.side == other {
+			return false
+		}
+	}
+	return true
+}
+
+// runeRef refers to a treeRune in one of the versions.
+type runeRef struct {
+	trs []treeRune
+	idx int
+}
+
+// mergeSide gives the treeRunes for the range lo to hi of the base, after the hunks from the given side are applied.
+func mergeSide(sources []*source, group []hunk, side, lo, hi int) []runeRef {
+	base, edit := *sources[0].treeRunes, *sources[side].treeRunes
+	var ret []runeRef
+	baseIdx := lo
+	for _, h := range group {
+		if h.side != side {
+			continue
+		}
+		for ; baseIdx < h.A; baseIdx++ {
+			ret = append(ret, runeRef{base, baseIdx})
+		}
+		for i := h.B; i < h.B+h.Ins; i++ {
+			if i >= sources[side].firstLeaf {
+				ret = append(ret, runeRef{edit, i})
+			}
+		}
+		baseIdx = h.A + h.Del
+	}
+	for ; baseIdx < hi; baseIdx++ {
+		ret = append(ret, runeRef{base, baseIdx})
+	}
+	return ret
+}
+
+// sameRunes returns true if both sides of a merge give the same treeRunes.
+func sameRunes(a, b []runeRef) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !treeRunesEqual(&a[i].trs[a[i].idx], &b[i].trs[b[i].idx]) {
+			return false
+		}
+	}
+	return true
+}
+
+// appendRunes appends all of the treeRunes with the given action.
+func appendRunes(app *appendContext, action rune, refs []runeRef) {
+	for _, r := range refs {
+		app.append(action, r.trs, r.idx, nil)
+	}
+}
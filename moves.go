@@ -0,0 +1,165 @@
+package htmldiff
+
+import (
+	"context"
+	"strconv"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// moveSimilarity is the proportion of letters a deleted and an inserted run must have in common to be marked as a move.
+const moveSimilarity = 0.8
+
+// editRun is a run of consecutive entries in the editList with the same action, within the same block-level element.
+type editRun struct {
+	start, end int // the range of entries
+	text       []rune
+	moved      bool
+}
+
+// editRuns finds the runs of deletions and insertions in the sorted editList.
+func (ap *appendContext) editRuns() (deleted, inserted []editRun) {
+	for i := 0; i < len(ap.editList); {
+		action, block := ap.editList[i].action, editBlock(ap.editList[i])
+		run := editRun{start: i}
+		for ; i < len(ap.editList) && ap.editList[i].action == action && editBlock(ap.editList[i]) == block; i++ {
+			e := ap.editList[i]
+			if e.proto != nil && e.proto.Type != html.TextNode {
+				run.text = append(run.text, 0) // so that an <img> is only matched with another <img>
+				run.text = append(run.text, []rune(e.proto.Data)...)
+			}
+			run.text = append(run.text, []rune(e.text)...)
+		}
+		run.end = i
+		switch action {
+		case '-':
+			deleted = append(deleted, run)
+		case '+':
+			inserted = append(inserted, run)
+		}
+	}
+	return deleted, inserted
+}
+
+// editBlock returns the block-level element containing the edit, if any.
+func editBlock(e editEntry) *html.Node {
+	if e.proto == nil {
+		return nil
+	}
+	return blockOf(e.proto)
+}
+
+// detectMoves marks each deleted run of at least c.DetectMoves letters, which has the same (or nearly the same) text as an inserted run,
+// as moved from the place where it was deleted to the place where it was inserted.
+// A run deleted and inserted in the same place, as when a paragraph becomes a heading, is not a move.
+// This counts against the c.MaxDiffDuration of the diff itself, so diffCtx is the context given to diffWithin(),
+// returning ErrDiffTimeout if what is left runs out, and stops as soon as ctx is done. On error, no moves are marked.
+func (c *Config) detectMoves(ctx, diffCtx context.Context, ap *appendContext) error {
+	cn := &canceller{ctx: diffCtx}
+	deleted, inserted := ap.editRuns()
+	var moves [][2]editRun // the runs moved from and to, marked once all are found
+	for _, del := range deleted {
+		if len(del.text) < c.DetectMoves {
+			continue
+		}
+		best, bestSimilarity := -1, moveSimilarity
+		for i, ins := range inserted {
+			if ins.moved || len(ins.text) < c.DetectMoves || ins.start == del.end || ins.end == del.start {
+				continue
+			}
+			s, err := similarity(cn, del.text, ins.text)
+			if err != nil {
+				if err == context.DeadlineExceeded && ctx.Err() == nil {
+					err = ErrDiffTimeout
+				}
+				return err
+			}
+			if s >= bestSimilarity {
+				best, bestSimilarity = i, s
+			}
+		}
+		if best < 0 {
+			continue
+		}
+		inserted[best].moved = true
+		moves = append(moves, [2]editRun{del, inserted[best]})
+	}
+	for m, runs := range moves {
+		ap.setMove(runs[0], '{', m+1)
+		ap.setMove(runs[1], '}', m+1)
+	}
+	return nil
+}
+
+// setMove gives the action and move number to the run of entries in the editList.
+func (ap *appendContext) setMove(run editRun, action rune, move int) {
+	for i := run.start; i < run.end; i++ {
+		ap.editList[i].action, ap.editList[i].move = action, move
+	}
+}
+
+// similarity returns the proportion of letters that two texts have in common, from zero to one,
+// or the error from diffContext if the context of cn is done.
+func similarity(cn *canceller, a, b []rune) (float64, error) {
+	total := len(a) + len(b)
+	if total == 0 {
+		return 1, nil
+	}
+	shorter, longer := len(a), len(b)
+	if shorter > longer {
+		shorter, longer = longer, shorter
+	}
+	if float64(2*shorter)/float64(total) < moveSimilarity {
+		return 0, nil // the lengths are too different to be similar enough, so don't compare them
+	}
+	changes, err := diffContext(cn.ctx, len(a), len(b), runeData{a, b, cn})
+	if err != nil {
+		return 0, err
+	}
+	different := 0
+	for _, ch := range changes {
+		different += ch.Del + ch.Ins
+	}
+	return float64(total-different) / float64(total), nil
+}
+
+// runeData provides a diff.Data interface for two texts, which checks for cancellation.
+type runeData struct {
+	a, b   []rune
+	cancel *canceller
+}
+
+// Equal exists to fulfill the diff.Data interface.
+func (rd runeData) Equal(i, j int) bool {
+	rd.cancel.check()
+	return rd.a[i] == rd.b[j]
+}
+
+// moveNode returns a new element to wrap text moved from or to another place, with the id of the move.
+// For InsDelMarkup the place moved from is a <del> and the place moved to an <ins>, and for TrackChangesMarkup
+// they are a deletion and an insertion, with the change ids "<id>-from" and "<id>-to" so that the editor can tell them apart.
+func (c *Config) moveNode(action rune, id int) *html.Node {
+	direction, as := "from", '-'
+	if action == '}' {
+		direction, as = "to", '+'
+	}
+	n := &html.Node{
+		Type:     html.ElementNode,
+		DataAtom: atom.Span,
+		Data:     "span",
+	}
+	switch c.Markup {
+	case TrackChangesMarkup:
+		c.trackChangesNode(n, as, strconv.Itoa(id)+"-"+direction)
+	case InsDelMarkup:
+		n.Attr = convertAttributes(c.MovedSpan)
+		c.insDelNode(n, as)
+	default:
+		n.Attr = convertAttributes(c.MovedSpan)
+	}
+	n.Attr = append(n.Attr,
+		html.Attribute{Key: "data-move-id", Val: strconv.Itoa(id)},
+		html.Attribute{Key: "data-move", Val: direction})
+	return n
+}
@@ -31,24 +31,6 @@ func findBody(n *html.Node) *html.Node {
 	return nil
 }
 
-// find the first leaf in the tree that is a text node.
-func firstLeaf(n *html.Node) (*html.Node, bool) {
-	if n != nil {
-		switch n.Type {
-		case html.TextNode:
-			return n, true
-		}
-		// no valid node found
-		for c := n.FirstChild; c != nil; c = c.NextSibling {
-			r, ok := firstLeaf(c)
-			if ok {
-				return r, ok
-			}
-		}
-	}
-	return nil, false
-}
-
 // find if this or any parent is a container element where position is important like a list or table.
 func inContainer(n *html.Node) bool {
 	if n == nil {
@@ -0,0 +1,127 @@
+package htmldiff
+
+import (
+	"strings"
+	"unicode/utf8"
+
+	"github.com/mb0/diff"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// nodePairs records the elements of the versions compared which have text in common, as found by the diff,
+// so that the elements of each version can be told apart when the versions are written together, see appendContext.sameElement().
+type nodePairs struct {
+	base     *html.Node                  // the root of the base version
+	paired   map[[2]*html.Node]int       // the letters in common to each pair of elements, from the base and another version
+	partners map[*html.Node][]*html.Node // for each element, the elements of other versions with which it is paired
+	best     map[*html.Node]int          // for each element, the most letters it has in common with any other
+}
+
+// newNodePairs returns an empty nodePairs for versions compared with the base version, whose tree has the given root.
+func newNodePairs(base *html.Node) *nodePairs {
+	return &nodePairs{
+		base:     base,
+		paired:   make(map[[2]*html.Node]int),
+		partners: make(map[*html.Node][]*html.Node),
+		best:     make(map[*html.Node]int),
+	}
+}
+
+// add pairs two leaves with text in common, one from the base and one from another version,
+// along with those of their ancestors which have the same names.
+func (np *nodePairs) add(base, other *html.Node, text string) {
+	letters := utf8.RuneCountInString(text)
+	if letters == 0 {
+		letters = 1 // for elements like <img>
+	}
+	for a, b := base, other; a != nil && b != nil; a, b = a.Parent, b.Parent {
+		if a.Type != b.Type || a.DataAtom != b.DataAtom || a.Type == html.ElementNode && a.Data != b.Data {
+			return
+		}
+		if a.Type == html.ElementNode && (a.DataAtom == atom.Body || a.DataAtom == atom.Html) {
+			return
+		}
+		key := [2]*html.Node{a, b}
+		if np.paired[key] == 0 {
+			np.partners[a] = append(np.partners[a], b)
+			np.partners[b] = append(np.partners[b], a)
+		}
+		np.paired[key] += letters
+		for _, n := range key {
+			if np.paired[key] > np.best[n] {
+				np.best[n] = np.paired[key]
+			}
+		}
+	}
+}
+
+// addChanges pairs the leaves which the changes found by the diff leave unchanged, from the base a to the other version b.
+func (np *nodePairs) addChanges(a, b []treeRune, changes []diff.Change) {
+	aIdx, bIdx := 0, 0
+	same := func(end int) {
+		for ; aIdx < end && bIdx < len(b); aIdx, bIdx = aIdx+1, bIdx+1 {
+			np.add(a[aIdx].leaf, b[bIdx].leaf, a[aIdx].text())
+		}
+	}
+	for _, ch := range changes {
+		same(ch.A)
+		aIdx, bIdx = ch.A+ch.Del, ch.B+ch.Ins
+	}
+	same(len(a))
+}
+
+// sameElement returns true if two elements of different versions are paired, either directly or through the same element of the base.
+// If strict is false, it also returns true if neither element is paired with any other and one of them is in the base,
+// as for an element whose text has been entirely replaced. If strict is true, the elements must also have more text in common
+// with each other than with any other element.
+func (np *nodePairs) sameElement(a, b *html.Node, strict bool) bool {
+	rootA, rootB := treeRoot(a), treeRoot(b)
+	if rootA == np.base || rootB == np.base {
+		if rootB == np.base {
+			a, b = b, a
+		}
+		if strict {
+			n := np.paired[[2]*html.Node{a, b}]
+			return n > 0 && n == np.best[a] && n == np.best[b]
+		}
+		return np.paired[[2]*html.Node{a, b}] > 0 || len(np.partners[a]) == 0 && len(np.partners[b]) == 0
+	}
+	for _, pa := range np.partners[a] {
+		if np.paired[[2]*html.Node{pa, b}] > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// pairEntries pairs the elements of the two versions compared, given the text they have in common from the editList.
+// Whitespace alone is not enough to pair them.
+func (ap *appendContext) pairEntries() {
+	for _, e := range ap.editList {
+		if e.proto == nil || e.other == nil || e.proto.Type == html.TextNode && strings.TrimSpace(e.text) == "" {
+			continue
+		}
+		switch e.action {
+		case '=':
+			if ap.pairs == nil {
+				ap.pairs = newNodePairs(treeRoot(e.proto))
+			}
+			ap.pairs.add(e.proto, e.other, e.text)
+		case '~':
+			if ap.pairs == nil {
+				ap.pairs = newNodePairs(treeRoot(e.other))
+			}
+			ap.pairs.add(e.other, e.proto, e.text)
+		}
+	}
+}
+
+// treeRoot returns the node at the top of the tree containing n.
+func treeRoot(n *html.Node) *html.Node {
+	for n.Parent != nil {
+		n = n.Parent
+	}
+	return n
+}
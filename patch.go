@@ -0,0 +1,433 @@
+package htmldiff
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"unicode/utf8"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// Patch is a compact description of the changes from one version of the HTML to another, which can be serialised as JSON.
+// Only the content of the <body> is patched.
+type Patch struct {
+	Hunks []Hunk `json:"hunks"`
+}
+
+// Hunk replaces the Deleted fragments, found at Pos in the old version, with the Inserted fragments.
+// Pos counts the letters within the <body> before the hunk, with each leaf element (such as <img>) or comment counting as one.
+type Hunk struct {
+	Pos      int        `json:"pos"`
+	Deleted  []Fragment `json:"deleted,omitempty"`
+	Inserted []Fragment `json:"inserted,omitempty"`
+}
+
+// Fragment is a run of text, a comment or a leaf element (such as <img>), with where it is in the HTML.
+type Fragment struct {
+	Text    string         `json:"text,omitempty"`    // empty for a leaf element
+	Comment bool           `json:"comment,omitempty"` // the Text is a comment
+	Index   int            `json:"index,omitempty"`   // for text or a comment, the number of elements before it within its parent
+	Path    []PatchElement `json:"path,omitempty"`    // the elements from within the <body> down to the text, or to the leaf element itself
+}
+
+// PatchElement is an element on the Path to a Fragment.
+type PatchElement struct {
+	Tag       string      `json:"tag"`
+	Namespace string      `json:"ns,omitempty"`
+	Attr      []Attribute `json:"attr,omitempty"`
+	Index     int         `json:"index,omitempty"` // the number of elements before this one within its parent
+}
+
+// ErrPatchMismatch is returned by Apply if the Deleted fragments of the patch are not found in the HTML.
+var ErrPatchMismatch = errors.New("patch does not match the HTML it is applied to")
+
+// Diff finds the differences between two versions of the HTML, in the same way as HTMLdiff, but returns them as a Patch.
+// Where the text is the same, but the elements around it differ, the text is deleted and inserted again.
+func (c *Config) Diff(base, edit string) (*Patch, error) {
+	return c.DiffContext(context.Background(), base, edit)
+}
+
+// DiffContext is the same as Diff, except that the work stops as soon as ctx is done, returning ctx.Err().
+func (c *Config) DiffContext(ctx context.Context, base, edit string) (*Patch, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel() // on error return, stop any work still in progress
+	sources, err := c.parseVersions(ctx, stringVersions([]string{base, edit}))
+	if err != nil {
+		return nil, err
+	}
+	changes, _, err := c.diffSources(ctx, sources[0], sources[1])
+	if err != nil {
+		return nil, err
+	}
+
+	a, b := *sources[0].treeRunes, *sources[1].treeRunes
+	pb := &patchBuilder{}
+	aIdx, bIdx := 0, 0
+	same := func(end int) { // up to end in a
+		for ; aIdx < end && bIdx < len(b); aIdx, bIdx = aIdx+1, bIdx+1 {
+			if sameBranch(a[aIdx].leaf, b[bIdx].leaf) {
+				pb.same(a[aIdx])
+			} else {
+				pb.delete(a[aIdx])
+				pb.insert(b[bIdx])
+			}
+		}
+	}
+	for _, change := range changes {
+		same(change.A)
+		for i := 0; i < change.Del && aIdx < len(a); i, aIdx = i+1, aIdx+1 {
+			pb.delete(a[aIdx])
+		}
+		for i := 0; i < change.Ins && bIdx < len(b); i, bIdx = i+1, bIdx+1 {
+			pb.insert(b[bIdx])
+		}
+	}
+	same(len(a))
+	for ; aIdx < len(a); aIdx++ {
+		pb.delete(a[aIdx])
+	}
+	for ; bIdx < len(b); bIdx++ {
+		pb.insert(b[bIdx])
+	}
+	pb.endHunk()
+	return &pb.patch, nil
+}
+
+// patchBuilder holds the state while building a Patch.
+type patchBuilder struct {
+	patch                 Patch
+	hunk                  *Hunk
+	pos                   int // in letters
+	lastDeleted, lastLeaf *html.Node
+}
+
+// same moves past a treeRune which is the same in both versions.
+func (pb *patchBuilder) same(tr treeRune) {
+	pb.endHunk()
+	if inBody(tr.leaf) {
+		pb.pos += treeRuneLen(tr)
+	}
+}
+
+// delete adds a treeRune from the old version to the Deleted fragments of the current hunk.
+func (pb *patchBuilder) delete(tr treeRune) {
+	if !inBody(tr.leaf) {
+		return
+	}
+	h := pb.startHunk()
+	if tr.leaf.Type == html.TextNode && tr.leaf == pb.lastDeleted {
+		h.Deleted[len(h.Deleted)-1].Text += tr.text()
+	} else {
+		h.Deleted = append(h.Deleted, makeFragment(tr))
+	}
+	pb.lastDeleted = tr.leaf
+	pb.pos += treeRuneLen(tr)
+}
+
+// insert adds a treeRune from the new version to the Inserted fragments of the current hunk.
+func (pb *patchBuilder) insert(tr treeRune) {
+	if !inBody(tr.leaf) {
+		return
+	}
+	h := pb.startHunk()
+	if tr.leaf.Type == html.TextNode && tr.leaf == pb.lastLeaf {
+		h.Inserted[len(h.Inserted)-1].Text += tr.text()
+	} else {
+		h.Inserted = append(h.Inserted, makeFragment(tr))
+	}
+	pb.lastLeaf = tr.leaf
+}
+
+// startHunk returns the current hunk, starting a new one if required.
+func (pb *patchBuilder) startHunk() *Hunk {
+	if pb.hunk == nil {
+		pb.hunk = &Hunk{Pos: pb.pos}
+	}
+	return pb.hunk
+}
+
+// endHunk adds the current hunk, if any, to the patch.
+func (pb *patchBuilder) endHunk() {
+	if pb.hunk != nil {
+		pb.patch.Hunks = append(pb.patch.Hunks, *pb.hunk)
+	}
+	pb.hunk, pb.lastDeleted, pb.lastLeaf = nil, nil, nil
+}
+
+// treeRuneLen gives the length of a treeRune in letters, with other leaves counting as one.
+func treeRuneLen(tr treeRune) int {
+	if n := utf8.RuneCountInString(tr.text()); n > 0 {
+		return n
+	}
+	return 1
+}
+
+// fragmentLen gives the length of a Fragment in letters, with other leaves counting as one.
+func fragmentLen(f Fragment) int {
+	if n := utf8.RuneCountInString(f.Text); n > 0 && !f.Comment {
+		return n
+	}
+	return 1
+}
+
+// inBody returns true if the node is within the <body>.
+func inBody(n *html.Node) bool {
+	for n = n.Parent; n != nil; n = n.Parent {
+		if n.Type == html.ElementNode && n.DataAtom == atom.Body {
+			return true
+		}
+	}
+	return false
+}
+
+// elementsBefore gives the number of element siblings before the node.
+func elementsBefore(n *html.Node) int {
+	before := 0
+	for sib := n.PrevSibling; sib != nil; sib = sib.PrevSibling {
+		if sib.Type == html.ElementNode {
+			before++
+		}
+	}
+	return before
+}
+
+// sameBranch returns true if two leaves are the same kind of node, in the same places in the same elements, all the way up to the <body>.
+func sameBranch(a, b *html.Node) bool {
+	for ; a != nil && b != nil; a, b = a.Parent, b.Parent {
+		if a.Type != b.Type || elementsBefore(a) != elementsBefore(b) {
+			return false
+		}
+		if a.Type == html.CommentNode && a.Data != b.Data {
+			return false
+		}
+		if a.Type == html.ElementNode {
+			if !nodeEqual(a, b) {
+				return false
+			}
+			if a.DataAtom == atom.Body {
+				return true
+			}
+		}
+	}
+	return a == nil && b == nil
+}
+
+// makeFragment describes the treeRune, and where it is, as a Fragment.
+func makeFragment(tr treeRune) Fragment {
+	var f Fragment
+	n := tr.leaf
+	switch n.Type {
+	case html.TextNode:
+		f.Text, f.Index = tr.text(), elementsBefore(n)
+		n = n.Parent
+	case html.CommentNode:
+		f.Text, f.Comment, f.Index = n.Data, true, elementsBefore(n)
+		n = n.Parent
+	}
+	for ; n != nil && !(n.Type == html.ElementNode && n.DataAtom == atom.Body); n = n.Parent {
+		pe := PatchElement{Tag: n.Data, Namespace: n.Namespace, Index: elementsBefore(n)}
+		for _, a := range n.Attr {
+			pe.Attr = append(pe.Attr, Attribute{Namespace: a.Namespace, Key: a.Key, Val: a.Val})
+		}
+		f.Path = append([]PatchElement{pe}, f.Path...)
+	}
+	return f
+}
+
+// Apply makes the new version of the HTML, by applying the patch (made by Diff, with the same CleanTags) to the base version.
+// The result is the body of the new version, as parsed and cleaned, so applying an empty (or nil) patch gives the body of the base.
+func (c *Config) Apply(base string, p *Patch) (string, error) {
+	return c.ApplyContext(context.Background(), base, p)
+}
+
+// ApplyContext is the same as Apply, except that the work stops as soon as ctx is done, returning ctx.Err().
+func (c *Config) ApplyContext(ctx context.Context, base string, p *Patch) (string, error) {
+	if p == nil {
+		p = &Patch{}
+	}
+	rc := *c
+	rc.Tokenization, rc.Tokenizer = ByRune, nil // so that the positions are in letters
+	src, err := rc.parse(ctx, base)
+	if err != nil {
+		return "", err
+	}
+	a := *src.treeRunes // with one letter, or other leaf, in each treeRune
+	pw := newPatchWriter()
+	aIdx, pos := 0, 0 // pos counts the treeRunes within the body
+	same := func(end int) {
+		for ; aIdx < len(a) && (pos < end || !inBody(a[aIdx].leaf)); aIdx++ {
+			if inBody(a[aIdx].leaf) {
+				pw.same(a[aIdx])
+				pos++
+			}
+		}
+	}
+	for hi, h := range p.Hunks {
+		if hi%cancelCheckInterval == 0 && ctx.Err() != nil {
+			return "", ctx.Err()
+		}
+		if h.Pos < pos {
+			return "", ErrPatchMismatch
+		}
+		same(h.Pos)
+		for _, f := range h.Deleted {
+			if !fragmentMatches(f, a[aIdx:]) {
+				return "", ErrPatchMismatch
+			}
+			aIdx += fragmentLen(f)
+			pos += fragmentLen(f)
+		}
+		for _, f := range h.Inserted {
+			pw.write(f)
+		}
+	}
+	same(len(a))
+	var buf bytes.Buffer
+	if err := c.renderBody(&buf, pw.body); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// patchWriter builds the body of the new version of the HTML from the fragments of the base which are unchanged and those inserted,
+// in the order they appear in the new version. As the Path of each fragment gives the elements around it, and their places,
+// in the new version, the elements of the new version are made again as the fragments are written.
+type patchWriter struct {
+	body     *html.Node
+	lastLeaf *html.Node // the leaf of the base written last, see same()
+	lastPath []PatchElement
+	lastIdx  int
+}
+
+// newPatchWriter returns a patchWriter with an empty body.
+func newPatchWriter() *patchWriter {
+	body := &html.Node{Type: html.ElementNode, DataAtom: atom.Body, Data: "body"}
+	(&html.Node{Type: html.ElementNode, DataAtom: atom.Html, Data: "html"}).AppendChild(body)
+	return &patchWriter{body: body}
+}
+
+// same writes a treeRune of the base, which is unchanged in the new version.
+func (pw *patchWriter) same(tr treeRune) {
+	if tr.leaf != pw.lastLeaf { // only find the path to each leaf once
+		f := makeFragment(tr)
+		pw.lastLeaf, pw.lastPath, pw.lastIdx = tr.leaf, f.Path, f.Index
+	}
+	f := Fragment{Path: pw.lastPath, Index: pw.lastIdx}
+	switch tr.leaf.Type {
+	case html.TextNode:
+		f.Text = tr.text()
+	case html.CommentNode:
+		f.Text, f.Comment = tr.leaf.Data, true
+	}
+	pw.write(f)
+}
+
+// write adds a Fragment to the end of the body, within the elements on its Path.
+// The last element written at each level is used again if it is the same element, in the same place, otherwise a new one is made.
+func (pw *patchWriter) write(f Fragment) {
+	parent := pw.body
+	for i, pe := range f.Path {
+		last := parent.LastChild
+		leaf := i == len(f.Path)-1 && f.Text == "" && !f.Comment // a leaf element, such as <img>, is never used again
+		if !leaf && last != nil && last.Type == html.ElementNode && last.Data == pe.Tag && last.Namespace == pe.Namespace &&
+			elementsBefore(last) == pe.Index && sameAttributes(last.Attr, pe.Attr) {
+			parent = last
+			continue
+		}
+		n := &html.Node{
+			Type:      html.ElementNode,
+			DataAtom:  atom.Lookup([]byte(pe.Tag)),
+			Data:      pe.Tag,
+			Namespace: pe.Namespace,
+			Attr:      convertAttributes(pe.Attr),
+		}
+		parent.AppendChild(n)
+		parent = n
+	}
+	switch {
+	case f.Comment:
+		parent.AppendChild(&html.Node{Type: html.CommentNode, Data: f.Text})
+	case f.Text == "":
+	case parent.LastChild != nil && parent.LastChild.Type == html.TextNode:
+		parent.LastChild.Data += f.Text
+	default:
+		parent.AppendChild(&html.Node{Type: html.TextNode, Data: f.Text})
+	}
+}
+
+// sameAttributes returns true if the attributes of a node are the same as those of a PatchElement.
+func sameAttributes(attr []html.Attribute, pa []Attribute) bool {
+	if len(attr) != len(pa) {
+		return false
+	}
+	for i, a := range attr {
+		if a.Namespace != pa[i].Namespace || a.Key != pa[i].Key || a.Val != pa[i].Val {
+			return false
+		}
+	}
+	return true
+}
+
+// fragmentMatches returns true if the Fragment is found, in the same place, at the start of the treeRunes,
+// which must each have one letter or other leaf.
+func fragmentMatches(f Fragment, trs []treeRune) bool {
+	if len(trs) < fragmentLen(f) {
+		return false
+	}
+	if found := makeFragment(trs[0]); found.Comment != f.Comment || found.Index != f.Index || !samePath(found.Path, f.Path) {
+		return false
+	}
+	switch {
+	case f.Comment:
+		return trs[0].leaf.Data == f.Text
+	case f.Text == "":
+		return trs[0].leaf.Type == html.ElementNode
+	}
+	i := 0
+	for _, r := range f.Text {
+		if trs[i].leaf != trs[0].leaf || trs[i].letter != r {
+			return false
+		}
+		i++
+	}
+	return true
+}
+
+// samePath returns true if the two paths have the same elements, with the same attributes, in the same places.
+func samePath(a, b []PatchElement) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].Tag != b[i].Tag || a[i].Namespace != b[i].Namespace || a[i].Index != b[i].Index || len(a[i].Attr) != len(b[i].Attr) {
+			return false
+		}
+		for j := range a[i].Attr {
+			if a[i].Attr[j] != b[i].Attr[j] {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// Invert returns the patch which undoes the given patch.
+func Invert(p *Patch) *Patch {
+	if p == nil {
+		return &Patch{}
+	}
+	inv := &Patch{Hunks: make([]Hunk, 0, len(p.Hunks))}
+	offset := 0 // the change in length from the hunks so far
+	for _, h := range p.Hunks {
+		inv.Hunks = append(inv.Hunks, Hunk{Pos: h.Pos + offset, Deleted: h.Inserted, Inserted: h.Deleted})
+		for _, f := range h.Inserted {
+			offset += fragmentLen(f)
+		}
+		for _, f := range h.Deleted {
+			offset -= fragmentLen(f)
+		}
+	}
+	return inv
+}
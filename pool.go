@@ -0,0 +1,70 @@
+package htmldiff
+
+import (
+	"context"
+	"sync"
+)
+
+// parallel calls work(ctx, i) for each i from 0 to n-1, using at most c.MaxConcurrency goroutines at once,
+// or only the calling goroutine if c.MaxConcurrency is one. On the first error, the context passed to work
+// is cancelled and no more work is started. It only returns, with the first error found, once all the work has stopped.
+func (c *Config) parallel(ctx context.Context, n int, work func(ctx context.Context, i int) error) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	if c.MaxConcurrency == 1 {
+		for i := 0; i < n; i++ {
+			if err := work(ctx, i); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	workers := n
+	if c.MaxConcurrency > 0 && c.MaxConcurrency < n {
+		workers = c.MaxConcurrency
+	}
+	todo := make(chan int, n)
+	for i := 0; i < n; i++ {
+		todo <- i
+	}
+	close(todo)
+	var wg sync.WaitGroup
+	var once sync.Once
+	var firstErr error
+	failed := make(chan struct{})
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range todo {
+				select {
+				case <-failed:
+					return // an error has been found, so do no more
+				default:
+				}
+				if err := work(ctx, i); err != nil {
+					once.Do(func() {
+						firstErr = err
+						close(failed)
+						cancel() // stop any work still in progress
+					})
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	return firstErr
+}
+
+// parseVersions parses and prepares all of the versions, see parallel.
+func (c *Config) parseVersions(ctx context.Context, versions []Version) ([]*source, error) {
+	sources := make([]*source, len(versions))
+	err := c.parallel(ctx, len(versions), func(ctx context.Context, v int) (err error) {
+		sources[v], err = c.parseVersion(ctx, versions[v])
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return sources, nil
+}
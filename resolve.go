@@ -0,0 +1,97 @@
+package htmldiff
+
+import (
+	"context"
+	"errors"
+	"sort"
+)
+
+// AcceptAll is a decision function for Resolve which accepts every change.
+func AcceptAll(id int) bool { return true }
+
+// RejectAll is a decision function for Resolve which rejects every change.
+func RejectAll(id int) bool { return false }
+
+// AcceptIDs returns a decision function for Resolve which accepts only the changes with the given IDs.
+func AcceptIDs(ids ...int) func(id int) bool {
+	return func(id int) bool {
+		for _, i := range ids {
+			if i == id {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// ErrNotResolvable is returned by Resolve if the change list was not made by Changes.
+var ErrNotResolvable = errors.New("the change list was not made by Changes, so cannot be resolved")
+
+// Resolve writes the HTML that results from accepting or rejecting each of the changes in a list made by Changes,
+// as decided by calling accept once with the ID of each change. Accepting every change gives the body of the new version,
+// and rejecting every change gives the body of the base version, as parsed and cleaned by the Config used.
+// Unchanged parts take their formatting from the version chosen for the change before them, and the elements of each version
+// are only written as one where they have text in common, so that accepting a new paragraph does not add it to the one before.
+// The Change records refer to the parsed versions they came from, so the list must be the one returned by Changes,
+// not a copy which has been serialised (for example as JSON) or built by the caller; otherwise ErrNotResolvable is returned.
+func Resolve(changes []Change, accept func(id int) bool) (string, error) {
+	decisions := make(map[int]bool) // so that accept is called once for each change
+	decide := func(id int) bool {
+		d, ok := decisions[id]
+		if !ok {
+			d = accept(id)
+			decisions[id] = d
+		}
+		return d
+	}
+	accepted := true // the last decision made
+	for _, ch := range changes {
+		if ch.Action != Unchanged {
+			accepted = decide(ch.ID)
+			break
+		}
+	}
+	ap := &appendContext{c: &Config{}, strictPairs: true}
+	if len(changes) > 0 {
+		ap.c.FragmentContext, ap.pairs = changes[0].fragmentContext, changes[0].pairs
+	}
+	for _, ch := range changes {
+		e := ch.entry
+		if e == nil {
+			return "", ErrNotResolvable
+		}
+		if ch.Action != Unchanged {
+			accepted = decide(ch.ID)
+		}
+		chosen := editEntry{action: '=', text: e.text, origSeq: e.origSeq}
+		action := ch.Action
+		switch action {
+		case MovedFrom: // accepting a move deletes the text from where it was
+			action = Deleted
+		case MovedTo:
+			action = Inserted
+		}
+		switch {
+		case action == Unchanged && accepted && e.other != nil:
+			chosen.proto, chosen.pos = e.other, e.otherPos
+		case action == Unchanged, action == Deleted && !accepted, action == Inserted && accepted, action == Replaced && accepted:
+			chosen.proto, chosen.pos = e.proto, e.pos
+		case action == Replaced && e.other != nil: // rejected, so use the old formatting
+			chosen.proto, chosen.pos = e.other, e.otherPos
+		default:
+			continue
+		}
+		ap.editList = append(ap.editList, chosen)
+	}
+	// as in walkChanges, sort from the order the edits were found, because the containers of the chosen leaves may be in different positions
+	sort.Sort(bySeq(ap.editList))
+	sort.Stable(ap)
+	return ap.render(context.Background())
+}
+
+// bySeq sorts an editList into the order the edits were found.
+type bySeq []editEntry
+
+func (s bySeq) Len() int           { return len(s) }
+func (s bySeq) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s bySeq) Less(i, j int) bool { return s[i].origSeq < s[j].origSeq }
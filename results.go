@@ -0,0 +1,122 @@
+package htmldiff
+
+import (
+	"context"
+	"fmt"
+)
+
+// Stage is the stage of the work for an edit at which an error occurred.
+type Stage int
+
+// The stages at which a StageError may occur.
+const (
+	StageParse   Stage = iota + 1 // parsing a version
+	StageLimit                    // comparing the versions, when MaxRunes or MaxEditDistance is exceeded
+	StageTimeout                  // when MaxDiffDuration is exceeded, or the context's deadline passes at any stage
+	StageRender                   // writing the merged HTML
+	StageCancel                   // when the context is cancelled, at any stage
+	StageCompare                  // comparing the versions, for any other reason
+)
+
+// String returns the name of the Stage.
+func (s Stage) String() string {
+	switch s {
+	case StageParse:
+		return "parse"
+	case StageLimit:
+		return "limit"
+	case StageTimeout:
+		return "timeout"
+	case StageRender:
+		return "render"
+	case StageCancel:
+		return "cancel"
+	case StageCompare:
+		return "compare"
+	}
+	return "unknown"
+}
+
+// StageError is the error for an edit in a Result, giving the Stage at which it occurred.
+type StageError struct {
+	Stage   Stage
+	Version int // for StageParse, the index of the version which could not be parsed
+	Err     error
+}
+
+// Error is part of the error interface.
+func (se *StageError) Error() string {
+	if se.Stage == StageParse {
+		return fmt.Sprintf("htmldiff %s of version %d: %v", se.Stage, se.Version, se.Err)
+	}
+	return fmt.Sprintf("htmldiff %s: %v", se.Stage, se.Err)
+}
+
+// Unwrap returns the underlying error, for example ErrInputTooLarge.
+func (se *StageError) Unwrap() error {
+	return se.Err
+}
+
+// HTMLdiffResults is the same as HTMLdiffContext, except that it also returns the Fallback used for each merged HTML snippit,
+// and an error for one edit does not stop the others: each Result has either its merged HTML or its own Err.
+// The error returned is only for a problem with the arguments.
+func (c *Config) HTMLdiffResults(ctx context.Context, versions []string) ([]Result, error) {
+	if len(versions) < 2 {
+		return nil, errTooFewVersions
+	}
+	vv := stringVersions(versions)
+	sources := make([]*source, len(vv))
+	parseErrors := make([]error, len(vv))
+	c.parallel(ctx, len(vv), func(ctx context.Context, v int) error {
+		sources[v], parseErrors[v] = c.parseVersion(ctx, vv[v])
+		return nil // so that the other versions are still parsed
+	})
+
+	results := make([]Result, len(vv)-1)
+	c.parallel(ctx, len(results), func(ctx context.Context, m int) error {
+		results[m].Err = c.result(ctx, &results[m], sources, parseErrors, m)
+		return nil // so that the other edits are still compared
+	})
+	return results, nil
+}
+
+// result compares edit m, for HTMLdiffResults, filling in the Result or returning a *StageError.
+func (c *Config) result(ctx context.Context, r *Result, sources []*source, parseErrors []error, m int) error {
+	base := 0
+	if c.Chain {
+		base = m
+	}
+	for _, v := range []int{base, m + 1} {
+		if parseErrors[v] != nil {
+			return stageError(StageParse, v, parseErrors[v])
+		}
+	}
+	ap, err := c.compare(ctx, sources[base], sources[m+1])
+	switch err {
+	case nil:
+	case ErrInputTooLarge, ErrTooManyChanges:
+		return stageError(StageLimit, 0, err)
+	case ErrDiffTimeout:
+		return stageError(StageTimeout, 0, err)
+	default:
+		return stageError(StageCompare, 0, err)
+	}
+	merged, err := ap.render(ctx)
+	if err != nil {
+		return stageError(StageRender, 0, err)
+	}
+	r.HTML, r.Fallback = merged, ap.fallback
+	return nil
+}
+
+// stageError returns a *StageError for an error at the given stage, unless the error is from the context,
+// which gives StageTimeout or StageCancel wherever it happens.
+func stageError(stage Stage, version int, err error) *StageError {
+	switch err {
+	case context.DeadlineExceeded:
+		stage = StageTimeout
+	case context.Canceled:
+		stage = StageCancel
+	}
+	return &StageError{Stage: stage, Version: version, Err: err}
+}
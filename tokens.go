@@ -0,0 +1,158 @@
+package htmldiff
+
+import (
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Tokenizer splits the text of an HTML text node into the tokens to be compared, each of which is inserted,
+// deleted or unchanged as a whole. The tokens must not be empty and must concatenate to give the original text,
+// if they do not the text node is compared rune by rune.
+type Tokenizer interface {
+	Tokenize(text string) []string
+}
+
+// TokenizerFunc allows an ordinary function to be used as a Tokenizer.
+type TokenizerFunc func(text string) []string
+
+// Tokenize calls f(text).
+func (f TokenizerFunc) Tokenize(text string) []string {
+	return f(text)
+}
+
+// The Tokenizers provided by this package, which may be used as building blocks for others.
+var (
+	WordTokenizer     Tokenizer = TokenizerFunc(wordTokens)
+	SentenceTokenizer Tokenizer = TokenizerFunc(sentenceTokens)
+	GraphemeTokenizer Tokenizer = TokenizerFunc(graphemeTokens)
+)
+
+// Tokenization describes the units in which text is compared, if no Tokenizer is given in the Config.
+type Tokenization int
+
+// The ways that text can be split into tokens for comparison.
+const (
+	ByRune     Tokenization = iota // each rune is compared individually
+	ByWord                         // whole words, with each punctuation mark and each run of white space as a separate token
+	BySentence                     // whole sentences, with the white space between them as separate tokens
+	ByGrapheme                     // grapheme clusters, with runs of Chinese, Japanese, Thai (and similar) script kept together
+)
+
+// tokenizer returns the Tokenizer to use, or nil if text is compared rune by rune.
+func (c *Config) tokenizer() Tokenizer {
+	if c.Tokenizer != nil {
+		return c.Tokenizer
+	}
+	switch c.Tokenization {
+	case ByWord:
+		return WordTokenizer
+	case BySentence:
+		return SentenceTokenizer
+	case ByGrapheme:
+		return GraphemeTokenizer
+	}
+	return nil
+}
+
+// tokenize splits the text using the Tokenizer, returning nil if there is no Tokenizer or the result is not valid.
+func tokenize(tokenizer Tokenizer, text string) []string {
+	if tokenizer == nil {
+		return nil
+	}
+	tokens := tokenizer.Tokenize(text)
+	rest := text
+	for _, t := range tokens {
+		if t == "" || !strings.HasPrefix(rest, t) {
+			return nil
+		}
+		rest = rest[len(t):]
+	}
+	if rest != "" {
+		return nil
+	}
+	return tokens
+}
+
+// wordTokens splits text into words, punctuation marks and runs of white space, without splitting grapheme clusters.
+// Words in scripts that are written without spaces are split where the script changes.
+func wordTokens(text string) []string {
+	var tokens []string
+	start := -1 // of the current word or white space
+	var inSpace bool
+	var lastScript *unicode.RangeTable
+	for i := 0; i < len(text); {
+		r, _ := utf8.DecodeRuneInString(text[i:])
+		size := clusterSize(text[i:])
+		script := unspacedScript(r, lastScript)
+		switch {
+		case unicode.IsLetter(r) || unicode.IsDigit(r) || (unicode.IsMark(r) && start >= 0 && !inSpace):
+			if start >= 0 && (inSpace || script != lastScript) {
+				tokens = append(tokens, text[start:i])
+				start = -1
+			}
+			if start < 0 {
+				start, inSpace = i, false
+			}
+		case unicode.IsSpace(r):
+			if start >= 0 && !inSpace {
+				tokens = append(tokens, text[start:i])
+				start = -1
+			}
+			if start < 0 {
+				start, inSpace = i, true
+			}
+		default: // punctuation and everything else is a token on its own
+			if start >= 0 {
+				tokens = append(tokens, text[start:i])
+				start = -1
+			}
+			tokens = append(tokens, text[i:i+size])
+		}
+		lastScript = script
+		i += size
+	}
+	if start >= 0 {
+		tokens = append(tokens, text[start:])
+	}
+	return tokens
+}
+
+// sentenceTokens splits text into sentences, each including its closing punctuation, and runs of white space.
+func sentenceTokens(text string) []string {
+	const terminators, cjkTerminators, closers = ".!?", "。！？", `"')]}’”»」』`
+	var tokens []string
+	start := 0
+	var inSpace, ended, cjkEnded bool
+	for i := 0; i < len(text); {
+		r, size := utf8.DecodeRuneInString(text[i:])
+		space := unicode.IsSpace(r)
+		switch {
+		case i == start: // the first rune of the token
+		case inSpace && !space, // the end of a run of white space
+			!inSpace && space && ended, // the end of a sentence
+			cjkEnded && !strings.ContainsRune(closers+terminators+cjkTerminators, r): // CJK sentences need no space after
+			tokens = append(tokens, text[start:i])
+			start = i
+		}
+		if i == start {
+			inSpace, ended, cjkEnded = space, false, false
+		}
+		if !space {
+			switch {
+			case strings.ContainsRune(terminators, r):
+				ended = true
+			case strings.ContainsRune(cjkTerminators, r):
+				ended, cjkEnded = true, true
+			case ended && strings.ContainsRune(closers, r): // closing quotes and brackets are part of the sentence
+			default:
+				ended, cjkEnded = false, false
+			}
+		}
+		i += size
+	}
+	if start < len(text) {
+		tokens = append(tokens, text[start:])
+	}
+	return tokens
+}
@@ -1,33 +1,60 @@
 package htmldiff
 
 import (
+	"unicode/utf8"
+
 	"github.com/mb0/diff"
 
 	"golang.org/x/net/html"
 )
 
 // treeRune holds an individual rune in the HTML along with the node it is in and, for convienience, its position (if in a container).
+// When text is compared in tokens longer than one rune, the letter is the first rune of the token.
 type treeRune struct {
 	leaf   *html.Node
 	letter rune
+	token  string // only set for tokens of more than one rune
 	pos    posT
 }
 
+// text returns the text that the treeRune represents.
+func (tr treeRune) text() string {
+	if tr.token != "" {
+		return tr.token
+	}
+	if tr.letter > 0 {
+		return string(tr.letter)
+	}
+	return ""
+}
+
+// sameText returns true if two treeRunes represent the same text.
+func (tr treeRune) sameText(other treeRune) bool {
+	return tr.letter == other.letter && tr.token == other.token
+}
+
 // diffData is a type that exists in order to provide a diff.Data interface. It holds the two sets of treeRunes to difference.
 type diffData struct {
-	a, b *[]treeRune
+	a, b   *[]treeRune
+	cancel *canceller
 }
 
 // Equal exists to fulfill the diff.Data interface.
 // NOTE: this is usually the most called function in the package!
 func (dd diffData) Equal(i, j int) bool {
-	if (*dd.a)[i].letter != (*dd.b)[j].letter {
+	dd.cancel.check()
+	return treeRunesEqual(&(*dd.a)[i], &(*dd.b)[j])
+}
+
+// treeRunesEqual checks that two treeRunes have the same text, in the same position, in branches that can be compared.
+func treeRunesEqual(a, b *treeRune) bool {
+	if !a.sameText(*b) {
 		return false
 	}
-	if !posEqual((*dd.a)[i].pos, (*dd.b)[j].pos) {
+	if !posEqual(a.pos, b.pos) {
 		return false
 	}
-	return nodeBranchesEqual((*dd.a)[i].leaf, (*dd.b)[j].leaf)
+	return nodeBranchesEqual(a.leaf, b.leaf)
 }
 
 // nodeBranchesEqual checks that two leaves come from branches that can be compared.
@@ -69,31 +96,43 @@ func nodeEqualExText(base, comp *html.Node) bool {
 	return attrEqual(base, comp)
 }
 
-// renders a tree of nodes into a slice of treeRunes.
-func renderTreeRunes(n *html.Node, tr *[]treeRune) {
+// renders a tree of nodes into a slice of treeRunes, splitting the text into tokens if there is a tokenizer.
+func renderTreeRunes(n *html.Node, tr *[]treeRune, tokenizer Tokenizer) {
 	p := getPos(n)
 	if n.FirstChild == nil { // it is a leaf node
 		switch n.Type {
 		case html.TextNode:
 			if len(n.Data) == 0 {
 				*tr = append(*tr, treeRune{leaf: n, letter: '\u200b' /* zero-width space */, pos: p}) // make sure we catch the node, even if no data
-			} else {
+			} else if tokens := tokenize(tokenizer, n.Data); tokens == nil {
 				for _, r := range []rune(n.Data) {
 					*tr = append(*tr, treeRune{leaf: n, letter: r, pos: p})
 				}
+			} else {
+				for _, t := range tokens {
+					r, size := utf8.DecodeRuneInString(t)
+					if size == len(t) {
+						*tr = append(*tr, treeRune{leaf: n, letter: r, pos: p})
+					} else {
+						*tr = append(*tr, treeRune{leaf: n, letter: r, token: t, pos: p})
+					}
+				}
 			}
 		default:
 			*tr = append(*tr, treeRune{leaf: n, letter: 0, pos: p})
 		}
 	} else {
 		for c := n.FirstChild; c != nil; c = c.NextSibling {
-			renderTreeRunes(c, tr)
+			renderTreeRunes(c, tr, tokenizer)
 		}
 	}
 }
 
 // wrapper for diff.Granular() -- should only concatanate changes for similar text nodes
 func granular(gran int, dd diffData, changes []diff.Change) []diff.Change {
+	if len(*dd.a) == 0 || len(*dd.b) == 0 { // everything inserted or deleted, so nothing to concatanate
+		return changes
+	}
 	ret := make([]diff.Change, 0, len(changes))
 	startSame := 0
 	changeCount := 0